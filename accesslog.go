@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// CommonAccessLogFormat is a text template for NewTemplateAccessLogger
+// modelled after the common log format
+const CommonAccessLogFormat = `{{.Client}} {{.SessionID}} {{or .Username "-"}} [{{.End.Format "02/Jan/2006:15:04:05 -0700"}}] "{{or .Command "-"}} {{or .DestAddr "-"}} {{or .RealDestAddr "-"}}" {{.Reply}} {{.BytesUp}} {{.BytesDown}} {{.Duration.Milliseconds}}ms "{{.Reason}}"
+`
+
+// AccessRecord describes a finished session
+type AccessRecord struct {
+	// SessionID identifies the session
+	SessionID string `json:"session"`
+	// Start is when the connection was accepted
+	Start time.Time `json:"start"`
+	// End is when the session was closed
+	End time.Time `json:"end"`
+	// Client address of the session
+	Client string `json:"client"`
+	// Username negotiated, if any
+	Username string `json:"user,omitempty"`
+	// Command requested, if the request was read
+	Command string `json:"command,omitempty"`
+	// DestAddr as requested by the client
+	DestAddr string `json:"dest,omitempty"`
+	// RealDestAddr after resolution and rewriting
+	RealDestAddr string `json:"real_dest,omitempty"`
+	// Reply code sent to the client, -1 if none was sent
+	Reply int `json:"reply"`
+	// BytesUp counts bytes read from the client
+	BytesUp int64 `json:"bytes_up"`
+	// BytesDown counts bytes written to the client
+	BytesDown int64 `json:"bytes_down"`
+	// Reason the session ended
+	Reason string `json:"reason"`
+
+	// Method, Host and Status are set on the records of the requests of
+	// an HTTP forward proxy client, written in addition to the record of
+	// its session
+	Method string `json:"method,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Duration is the time the session lasted
+func (r *AccessRecord) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// AccessLogger receives one record per finished session
+type AccessLogger interface {
+	LogAccess(rec *AccessRecord) error
+}
+
+type jsonAccessLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAccessLogger returns an AccessLogger writing each record to w
+// as a line of JSON
+func NewJSONAccessLogger(w io.Writer) AccessLogger {
+	return &jsonAccessLogger{enc: json.NewEncoder(w)}
+}
+
+// LogAccess implementation of AccessLogger
+func (l *jsonAccessLogger) LogAccess(rec *AccessRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(rec)
+}
+
+type templateAccessLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tmpl *template.Template
+}
+
+// NewTemplateAccessLogger returns an AccessLogger executing the text
+// template format with each *AccessRecord and writing the result to w,
+// see CommonAccessLogFormat
+func NewTemplateAccessLogger(w io.Writer, format string) (AccessLogger, error) {
+	tmpl, err := template.New("access").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	return &templateAccessLogger{w: w, tmpl: tmpl}, nil
+}
+
+// LogAccess implementation of AccessLogger
+func (l *templateAccessLogger) LogAccess(rec *AccessRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tmpl.Execute(l.w, rec)
+}
+
+// Session end reasons set by the server itself
+const (
+	endReasonCompleted  = "completed"
+	endReasonKilled     = "killed"
+	endReasonServerDown = "server closed"
+	endReasonLifetime   = "max session duration"
+)
+
+// logAccess writes the record of a session that ended with err to the
+// configured access log, if any
+func (s *Server) logAccess(ctx context.Context, sess *session, err error) {
+	if s.configFor(ctx).AccessLog != nil {
+		s.writeAccessRecord(ctx, sess.accessRecord(ctx, err))
+	}
+}
+
+// writeAccessRecord writes rec to the configured access log, if any
+func (s *Server) writeAccessRecord(ctx context.Context, rec *AccessRecord) {
+	accessLog := s.configFor(ctx).AccessLog
+	if accessLog == nil {
+		return
+	}
+	if err := accessLog.LogAccess(rec); err != nil {
+		s.logger(ctx).Error("failed to write access log", "error", err)
+	}
+}
+
+// outlived reports whether the session of ctx ended on the deadline of
+// MaxSessionDuration, rather than one of the context it was served with
+func (sess *session) outlived(ctx context.Context) bool {
+	if ctx.Err() != context.DeadlineExceeded || sess.lifetime.IsZero() {
+		return false
+	}
+	deadline, _ := ctx.Deadline()
+	return deadline.Equal(sess.lifetime)
+}
+
+// accessRecord builds the record of a session of ctx that ended with err
+func (sess *session) accessRecord(ctx context.Context, err error) *AccessRecord {
+	info := sess.info()
+	rec := &AccessRecord{
+		SessionID: info.ID,
+		Start:     info.StartTime,
+		End:       time.Now(),
+		Client:    info.RemoteAddr.String(),
+		Username:  info.Username,
+		Reply:     -1,
+		BytesUp:   info.BytesUp,
+		BytesDown: info.BytesDown,
+		Reason:    endReasonCompleted,
+	}
+	if info.Command != 0 {
+		rec.Command = commandName(info.Command)
+	}
+	if info.DestAddr != nil {
+		rec.DestAddr = info.DestAddr.String()
+	}
+	if info.RealDestAddr != nil {
+		rec.RealDestAddr = info.RealDestAddr.String()
+	}
+
+	sess.mu.Lock()
+	if sess.replied {
+		rec.Reply = int(sess.reply)
+	}
+	killReason := sess.killReason
+	sess.mu.Unlock()
+
+	switch {
+	case killReason != "":
+		rec.Reason = killReason
+	case sess.outlived(ctx):
+		rec.Reason = endReasonLifetime
+	case err != nil:
+		rec.Reason = err.Error()
+	}
+	return rec
+}
@@ -1,8 +1,10 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 )
 
 /*********************************
@@ -164,7 +166,7 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 }
 
 // authenticate is used to handle connection authentication
-func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+func (s *Server) authenticate(ctx context.Context, conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
@@ -173,16 +175,36 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 
 	// Select a usable method
 	for _, method := range methods {
-		cator, found := s.authMethods[method]
+		cator, found := s.sessionAuthMethods(ctx)[method]
 		if found {
-			return cator.Authenticate(bufConn, conn)
+			sessionFromContext(ctx).setPhase(PhaseAuth)
+			if c, ok := conn.(net.Conn); ok {
+				setConnDeadline(c, s.configFor(ctx).AuthTimeout)
+			}
+			authContext, err := cator.Authenticate(bufConn, conn)
+			s.configFor(ctx).Metrics.authAttempt(authMethodName(method), err)
+			return authContext, err
 		}
 	}
 
 	// No usable method found
+	s.configFor(ctx).Metrics.authAttempt(authMethodName(AuthMethodNoAcceptable), ErrNoSupportedAuth)
 	return nil, noAcceptableAuth(conn)
 }
 
+// authMethodName returns a readable name of an auth method
+func authMethodName(method uint8) string {
+	switch method {
+	case AuthMethodNoAuth:
+		return "no_auth"
+	case AuthMethodUserPass:
+		return "user_pass"
+	case AuthMethodNoAcceptable:
+		return "no_acceptable"
+	}
+	return fmt.Sprintf("method-%d", method)
+}
+
 // noAcceptableAuth is used to handle when we have no eligible
 // authentication mechanism
 func noAcceptableAuth(conn io.Writer) error {
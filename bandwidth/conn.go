@@ -3,20 +3,38 @@ package bandwidth
 import (
 	"context"
 	"net"
+	"time"
 )
 
+// WaitObserver is told how long a Read (read is true) or a Write of a
+// limited connection waited for its limiters
+type WaitObserver func(read bool, d time.Duration)
+
+type waitObserverKey struct{}
+
+// WithWaitObserver returns a copy of ctx carrying obs. Connections given
+// that context through WithContext report their waits to obs.
+func WithWaitObserver(ctx context.Context, obs WaitObserver) context.Context {
+	return context.WithValue(ctx, waitObserverKey{}, obs)
+}
+
 type bandwidthLimitedConnWrapper struct {
 	net.Conn
 	writeLimiter BandwidthLimiter
 	readLimiter  BandwidthLimiter
 
-	ctx context.Context
+	ctx     context.Context
+	observe WaitObserver
 }
 
 // Read data from a connection. The reads are rate limited at bytes per second.
 // len(b) must be bigger than the burst size set on the limiter, otherwise an error is returned.
 func (c *bandwidthLimitedConnWrapper) Read(b []byte) (int, error) {
+	start := time.Now()
 	err := c.readLimiter.WaitN(c.ctx, int64(len(b)))
+	if c.observe != nil {
+		c.observe(true, time.Since(start))
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -27,7 +45,11 @@ func (c *bandwidthLimitedConnWrapper) Read(b []byte) (int, error) {
 // Write data to a connection. The writes are rate limited at bytes per second.
 // len(b) must be bigger than the burst size set on the limiter, otherwise an error is returned.
 func (c *bandwidthLimitedConnWrapper) Write(b []byte) (int, error) {
+	start := time.Now()
 	err := c.writeLimiter.WaitN(c.ctx, int64(len(b)))
+	if c.observe != nil {
+		c.observe(false, time.Since(start))
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -35,6 +57,27 @@ func (c *bandwidthLimitedConnWrapper) Write(b []byte) (int, error) {
 	return c.Conn.Write(b)
 }
 
+// WithContext returns a shallow copy of the connection whose limiters wait
+// on ctx instead, so that cancelling ctx aborts any pending Read or Write.
+// The waits are reported to the WaitObserver of ctx, if any.
+func (c *bandwidthLimitedConnWrapper) WithContext(ctx context.Context) net.Conn {
+	c2 := *c
+	c2.ctx = ctx
+	c2.observe, _ = ctx.Value(waitObserverKey{}).(WaitObserver)
+	return &c2
+}
+
+// Limiters returns the read and write limiters of the connection, so
+// that other traffic of the same client can share them
+func (c *bandwidthLimitedConnWrapper) Limiters() (read, write BandwidthLimiter) {
+	return c.readLimiter, c.writeLimiter
+}
+
+// NetConn returns the rate limited connection
+func (c *bandwidthLimitedConnWrapper) NetConn() net.Conn {
+	return c.Conn
+}
+
 // NewBandwidthLimitedConn returns a net.Conn that has its Read method rate limited
 // by the limiter.
 func NewBandwidthLimitedConn(ctx context.Context, readLimiter BandwidthLimiter, writeLimiter BandwidthLimiter, conn net.Conn) net.Conn {
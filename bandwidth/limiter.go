@@ -2,12 +2,13 @@ package bandwidth
 
 import (
 	"context"
+	"time"
 )
 
 type limiter struct {
 	*Limiter
 	conf   *BandwidthConfig
-	parent BandwidthLimiter
+	parent *limiter
 }
 
 // Limiter abstracts the idea of a rate limiter in this package.
@@ -23,12 +24,21 @@ type BandwidthLimiter interface {
 	Child(conf *BandwidthConfig) BandwidthLimiter
 }
 
+// AllowLimiter is an optional interface of BandwidthLimiters, implemented
+// by the ones of this package, for dropping traffic over the limit
+// instead of delaying it.
+type AllowLimiter interface {
+	// AllowN reports whether n bytes may pass right now, consuming them
+	// from the limiter and its parents only if all of them allow it.
+	AllowN(n int64) bool
+}
+
 // NewBandwidthLimiter creates a limiter to use with tcp connection and tcp listener bytes per second rate limiting.
 func NewBandwidthLimiter(conf *BandwidthConfig) BandwidthLimiter {
 	return newBandwidthLimiter(nil, conf)
 }
 
-func newBandwidthLimiter(parent BandwidthLimiter, conf *BandwidthConfig) BandwidthLimiter {
+func newBandwidthLimiter(parent *limiter, conf *BandwidthConfig) BandwidthLimiter {
 	return &limiter{
 		conf:    conf,
 		Limiter: NewLimiter(Limit(conf.GetLimit()), conf.GetBurst()),
@@ -65,3 +75,28 @@ func (l *limiter) Configure(conf *BandwidthConfig) {
 	l.Limiter.SetLimit(Limit(conf.GetLimit()))
 	l.SetBurst(conf.GetBurst())
 }
+
+func (l *limiter) AllowN(n int64) bool {
+	return l.reserveNow(time.Now(), n) != nil
+}
+
+// reserveNow takes n tokens at t from l and its parents, returning the
+// reservations, or nil and none if any of them can't grant them at once
+func (l *limiter) reserveNow(t time.Time, n int64) []*Reservation {
+	var reserved []*Reservation
+	if l.parent != nil {
+		if reserved = l.parent.reserveNow(t, n); reserved == nil {
+			return nil
+		}
+	}
+
+	l.Configure(l.conf)
+	r := l.Limiter.reserveN(t, n, 0)
+	if !r.ok {
+		for _, pr := range reserved {
+			pr.CancelAt(t)
+		}
+		return nil
+	}
+	return append(reserved, &r)
+}
@@ -71,12 +71,23 @@ func (w *rateListWrapper) Accept() (net.Conn, error) {
 // NewListener returns a net.Listener that will apply rate limits to each connection and also globally for all connections
 // via the listenerConfig.ReadServerRate and listenerConfig.WriteServerRate configs.
 func NewListener(ctx context.Context, listenerConfig *ListenerConfig, listener net.Listener) net.Listener {
+	return NewSharedListener(ctx, listenerConfig,
+		NewBandwidthLimiter(listenerConfig.ReadServerRate),
+		NewBandwidthLimiter(listenerConfig.WriteServerRate),
+		listener)
+}
+
+// NewSharedListener is like NewListener, but the global limits are the
+// given server limiters, which several listeners can share so that
+// together they stay within one budget. The connection rates still come
+// from listenerConfig.
+func NewSharedListener(ctx context.Context, listenerConfig *ListenerConfig, serverRead, serverWrite BandwidthLimiter, listener net.Listener) net.Listener {
 
 	return &rateListWrapper{
 		Listener: listener,
 
-		serverReadLimiter:  NewBandwidthLimiter(listenerConfig.ReadServerRate),
-		serverWriteLimiter: NewBandwidthLimiter(listenerConfig.WriteServerRate),
+		serverReadLimiter:  serverRead,
+		serverWriteLimiter: serverWrite,
 
 		listenerConfig: listenerConfig,
 
@@ -0,0 +1,304 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ReplyError is the failure reply of a SOCKS5 server to a request
+type ReplyError struct {
+	// Code is one of the Reply* codes
+	Code uint8
+}
+
+func (e *ReplyError) Error() string {
+	return "socks5: " + replyText(e.Code)
+}
+
+// Is reports whether target is a ReplyError of the same code, so that
+// errors.Is(err, &ReplyError{Code: ReplyConnectionRefused}) works
+func (e *ReplyError) Is(target error) bool {
+	t, ok := target.(*ReplyError)
+	return ok && t.Code == e.Code
+}
+
+// replyText describes a reply code as RFC 1928 does
+func replyText(code uint8) string {
+	switch code {
+	case ReplySucceeded:
+		return "succeeded"
+	case ReplyServerFailure:
+		return "general SOCKS server failure"
+	case ReplyRuleFailure:
+		return "connection not allowed by ruleset"
+	case ReplyNetworkUnreachable:
+		return "network unreachable"
+	case ReplyHostUnreachable:
+		return "host unreachable"
+	case ReplyConnectionRefused:
+		return "connection refused"
+	case ReplyTTLExpired:
+		return "TTL expired"
+	case ReplyCommandNotSupported:
+		return "command not supported"
+	case ReplyAddrTypeNotSupported:
+		return "address type not supported"
+	}
+	return "unknown reply " + strconv.Itoa(int(code))
+}
+
+// errUnexpectedVersion the server answered with another SOCKS version
+var errUnexpectedVersion = errors.New("unexpected SOCKS version in server response")
+
+// Dialer connects to destinations through a SOCKS5 server. It
+// implements the Dial and DialContext methods of proxy.Dialer and
+// proxy.ContextDialer of golang.org/x/net/proxy.
+type Dialer struct {
+	// ProxyNetwork is the network of the server, defaults to "tcp"
+	ProxyNetwork string
+	// ProxyAddress is the address of the server
+	ProxyAddress string
+
+	// Username and Password authenticate with RFC 1929 when the server
+	// asks for it. Without a Username only "No Authentication" is
+	// offered.
+	Username string
+	Password string
+
+	// ResolveLocally resolves domain names before sending the request,
+	// by default the server resolves them
+	ResolveLocally bool
+
+	// Resolver resolves domain names when ResolveLocally is set,
+	// defaults to net.DefaultResolver
+	Resolver *net.Resolver
+
+	// ProxyDial connects to the server, defaults to a net.Dialer
+	ProxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// UDPOverTCP makes ListenPacket carry the datagrams on the control
+	// connection with the private UDP OVER TCP command, for networks
+	// blocking UDP. The server must support the command.
+	UDPOverTCP bool
+}
+
+// NewDialer returns a Dialer to the SOCKS5 server at address,
+// authenticating with username and password unless username is empty
+func NewDialer(address, username, password string) *Dialer {
+	return &Dialer{ProxyAddress: address, Username: username, Password: password}
+}
+
+// DialContext connects to addr through the server. Only TCP networks are
+// supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network: %s", network)
+	}
+	dest, err := d.destAddr(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: failed to connect to proxy %s: %v", d.ProxyAddress, err)
+	}
+	if _, err := d.handshake(ctx, conn, CommandConnect, dest); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dial connects to addr through the server
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// Transport returns an http.Transport with the settings of
+// http.DefaultTransport dialing through the server
+func (d *Dialer) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
+
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	network := d.ProxyNetwork
+	if network == "" {
+		network = "tcp"
+	}
+	if d.ProxyDial != nil {
+		return d.ProxyDial(ctx, network, d.ProxyAddress)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.ProxyAddress)
+}
+
+// destAddr parses addr, resolving its domain name if asked to
+func (d *Dialer) destAddr(ctx context.Context, network, addr string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("socks5: invalid port: %s", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: port}, nil
+	}
+	if !d.ResolveLocally {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: domain name too long: %s", host)
+		}
+		return &AddrSpec{FQDN: host, Port: port}, nil
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+	ips, err := resolver.LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: failed to resolve %s: %v", host, err)
+	}
+	return &AddrSpec{IP: ips[0], Port: port}, nil
+}
+
+// handshake negotiates authentication and sends the request of cmd to
+// dest over conn, returning the bound address of the reply. It is
+// bounded by the deadline of ctx and aborted once ctx is done.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, cmd uint8, dest *AddrSpec) (_ *AddrSpec, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if ctx.Done() != nil {
+		// Wait for the watcher, so that a cancellation it acted on is
+		// reported rather than leaving conn with an expired deadline
+		done := make(chan struct{})
+		errCh := make(chan error, 1)
+		defer func() {
+			close(done)
+			if ctxErr := <-errCh; ctxErr != nil {
+				err = ctxErr
+			}
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				// Unblock the handshake
+				conn.SetDeadline(time.Unix(1, 0))
+				errCh <- ctx.Err()
+			case <-done:
+				errCh <- nil
+			}
+		}()
+	}
+
+	bound, err := d.negotiate(conn, cmd, dest)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+	return bound, err
+}
+
+func (d *Dialer) negotiate(conn net.Conn, cmd uint8, dest *AddrSpec) (*AddrSpec, error) {
+	if err := d.authenticate(conn); err != nil {
+		return nil, err
+	}
+
+	// Send the request
+	req, err := appendAddrSpec([]byte{socks5Version, cmd, 0}, dest)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("socks5: failed to send request: %v", err)
+	}
+	return readReply(conn)
+}
+
+// readReply reads a reply, failing with a ReplyError unless it succeeded
+func readReply(r io.Reader) (*AddrSpec, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("socks5: failed to read reply: %v", err)
+	}
+	if header[0] != socks5Version {
+		return nil, errUnexpectedVersion
+	}
+	if header[1] != ReplySucceeded {
+		return nil, &ReplyError{Code: header[1]}
+	}
+	bound, err := readAddrSpec(r)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: failed to read bound address: %v", err)
+	}
+	return bound, nil
+}
+
+// authenticate offers "No Authentication" and, with a Username, RFC
+// 1929 username/password, and runs the method chosen by the server
+func (d *Dialer) authenticate(conn net.Conn) error {
+	methods := []byte{AuthMethodNoAuth}
+	if d.Username != "" {
+		methods = append(methods, AuthMethodUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("socks5: failed to send auth methods: %v", err)
+	}
+	resp := []byte{0, 0}
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return fmt.Errorf("socks5: failed to read auth method: %v", err)
+	}
+	if resp[0] != socks5Version {
+		return errUnexpectedVersion
+	}
+
+	switch resp[1] {
+	case AuthMethodNoAuth:
+		return nil
+	case AuthMethodUserPass:
+		if d.Username == "" {
+			break
+		}
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		msg := []byte{AuthUserPassVersion, byte(len(d.Username))}
+		msg = append(msg, d.Username...)
+		msg = append(msg, byte(len(d.Password)))
+		msg = append(msg, d.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return fmt.Errorf("socks5: failed to send credentials: %v", err)
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return fmt.Errorf("socks5: failed to read auth status: %v", err)
+		}
+		if resp[1] != AuthUserPassStatusSuccess {
+			return ErrUserAuthFailed
+		}
+		return nil
+	case AuthMethodNoAcceptable:
+		return ErrNoSupportedAuth
+	}
+	return fmt.Errorf("socks5: server chose unoffered auth method %d", resp[1])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.Writer appending to a file that is renamed
+// with a timestamp suffix and reopened once it exceeds maxSize bytes or
+// is older than maxAge. A zero limit disables that kind of rotation.
+type rotatingFile struct {
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(name string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+// rotate moves the current file aside and opens a new one
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", r.name, time.Now().Format("20060102-150405.000"))
+	err := os.Rename(r.name, rotated)
+	if oerr := r.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.opened) >= r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %v", r.name, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"codeberg.org/peterzam/socks5"
 	"codeberg.org/peterzam/socks5/bandwidth"
@@ -17,25 +28,193 @@ var (
 	port = flag.Int("port", 1080, "proxy port")
 	up   = flag.Int64("up", 0, "up speed in megabits")
 	down = flag.Int64("down", 0, "down speed in megabits")
+
+	advertiseIP = flag.String("advertise-ip", "", "address sent to clients for BIND and UDP ASSOCIATE, e.g. the public IP in front of a NAT")
+	udpFullCone = flag.Bool("udp-full-cone", false, "relay UDP datagrams from anyone to the mapping of a destination, not only from the destination address")
+	udpPolice   = flag.Bool("udp-police", false, "drop UDP datagrams over the -up and -down limits instead of delaying them")
+
+	listen = flag.String("listen", "", "comma separated listen addresses overriding -port, e.g. 0.0.0.0:1080,[::]:1080,unix:/run/socks5.sock")
+	users  = flag.String("users", "", "file of user:password lines, re-read on SIGHUP")
+
+	socks4 = flag.Bool("socks4", false, "serve SOCKS4 and SOCKS4a clients too, when no authentication is required")
+
+	httpProxy = flag.Bool("http", false, "serve HTTP proxy clients on the same port, authenticated with Basic Proxy-Authorization")
+	httpVia   = flag.String("http-via", "", "pseudonym added as Via header to requests and responses of HTTP forward proxy clients")
+	httpXFF   = flag.Bool("http-xff", false, "append the client IP to the X-Forwarded-For header of HTTP forward proxy requests")
+
+	accessLog        = flag.String("access-log", "", "access log file, - for stdout")
+	accessLogFormat  = flag.String("access-log-format", "json", "access log format: json, common or a text/template")
+	accessLogMaxSize = flag.Int64("access-log-max-size", 0, "rotate the access log after that many megabytes")
+	accessLogMaxAge  = flag.Duration("access-log-max-age", 0, "rotate the access log after that long, e.g. 24h")
+
+	proxyProtocol = flag.String("proxy-protocol", "", "comma separated CIDRs of load balancers sending a PROXY protocol v1/v2 header, e.g. 10.0.0.0/8")
+
+	tlsCert      = flag.String("tls-cert", "", "PEM certificate file, serves SOCKS over TLS; reloaded when changed or on SIGHUP")
+	tlsKey       = flag.String("tls-key", "", "PEM key file of -tls-cert")
+	clientCA     = flag.String("client-ca", "", "PEM file of CAs verifying client certificates, which then authenticate clients")
+	certIdentity = flag.String("client-cert-identity", "cn", "client certificate identity used as username: cn, dns, email or uri")
+
+	metricsAddr = flag.String("metrics", "", "listen address serving Prometheus metrics on /metrics, e.g. 127.0.0.1:9100")
 )
 
-func main() {
-	flag.Parse()
+// accessLogger and metrics are created once and kept across reloads
+var (
+	accessLogger socks5.AccessLogger
+	metrics      *socks5.Metrics
+)
 
+// newAccessLogger opens the access log from the flags
+func newAccessLogger() (socks5.AccessLogger, error) {
+	var w io.Writer = os.Stdout
+	if *accessLog != "-" {
+		f, err := newRotatingFile(*accessLog, *accessLogMaxSize*1024*1024, *accessLogMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	switch *accessLogFormat {
+	case "json":
+		return socks5.NewJSONAccessLogger(w), nil
+	case "common":
+		return socks5.NewTemplateAccessLogger(w, socks5.CommonAccessLogFormat)
+	}
+	return socks5.NewTemplateAccessLogger(w, *accessLogFormat+"\n")
+}
+
+// newConfig builds the server config from the flags and the users file
+func newConfig() (*socks5.Config, error) {
 	const byte2megabit int64 = 128 * 1024
 
 	socsk5conf := &socks5.Config{
 		Logger:    log.New(os.Stdout, "", log.LstdFlags),
 		BindIP:    socks5.GetInterfaceIpv4Addr(*inf),
 		Bandwidth: *bandwidth.NeweSimpleListenerConfig(*up*byte2megabit, *down*byte2megabit),
+		AccessLog: accessLogger,
+		Metrics:   metrics,
+
+		AdvertiseIP:          net.ParseIP(*advertiseIP),
+		UDPBandwidthPolicing: *udpPolice,
+
+		EnableSOCKS4:    *socks4,
+		EnableHTTPProxy: *httpProxy,
+
+		HTTPProxyVia:           *httpVia,
+		HTTPProxyXForwardedFor: *httpXFF,
 	}
 
+	if *udpFullCone {
+		socsk5conf.UDPFilter = socks5.UDPFilterEndpointIndependent
+	}
+
+	creds := socks5.StaticCredentials{}
 	if *user+*pass != "" {
-		creds := socks5.StaticCredentials{
-			*user: *pass,
+		creds[*user] = *pass
+	}
+	if *users != "" {
+		if err := readUsers(*users, creds); err != nil {
+			return nil, err
 		}
+	}
+	if *clientCA != "" {
+		identity, err := parseCertIdentity(*certIdentity)
+		if err != nil {
+			return nil, err
+		}
+		cator := socks5.TLSClientCertAuthenticator{Identity: identity}
+		socsk5conf.AuthMethods = append(socsk5conf.AuthMethods, cator)
+	}
+	if len(creds) > 0 {
 		cator := socks5.UserPassAuthenticator{Credentials: creds}
-		socsk5conf.AuthMethods = []socks5.Authenticator{cator}
+		socsk5conf.AuthMethods = append(socsk5conf.AuthMethods, cator)
+	}
+
+	return socsk5conf, nil
+}
+
+func parseCertIdentity(name string) (socks5.CertIdentity, error) {
+	switch name {
+	case "cn":
+		return socks5.CertIdentityCommonName, nil
+	case "dns":
+		return socks5.CertIdentityDNSName, nil
+	case "email":
+		return socks5.CertIdentityEmail, nil
+	case "uri":
+		return socks5.CertIdentityURI, nil
+	}
+	return 0, fmt.Errorf("unknown client certificate identity: %s", name)
+}
+
+// newTLSConfig builds the TLS config of the listeners from the flags
+func newTLSConfig() (*tls.Config, *socks5.CertReloader, error) {
+	certs, err := socks5.NewCertReloader(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf := &tls.Config{GetCertificate: certs.GetCertificate}
+	if *clientCA != "" {
+		pem, err := os.ReadFile(*clientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificate found in %s", *clientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, certs, nil
+}
+
+// readUsers adds the user:password lines of file to creds
+func readUsers(file string, creds socks5.StaticCredentials) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, password, ok := strings.Cut(text, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected user:password", file, line)
+		}
+		creds[name] = password
+	}
+	return scanner.Err()
+}
+
+func main() {
+	flag.Parse()
+
+	if *accessLog != "" {
+		l, err := newAccessLogger()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accessLogger = l
+	}
+
+	if *metricsAddr != "" {
+		metrics = socks5.NewMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
+		log.Printf("Serving metrics on %s/metrics\n", *metricsAddr)
+	}
+
+	socsk5conf, err := newConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	server, err := socks5.New(socsk5conf)
@@ -43,9 +222,69 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Printf("Start listening proxy service on port %s\n", strconv.Itoa(*port))
+	var (
+		tlsConf *tls.Config
+		certs   *socks5.CertReloader
+	)
+	if *tlsCert != "" {
+		if tlsConf, certs, err = newTLSConfig(); err != nil {
+			log.Fatal(err)
+		}
+	} else if *clientCA != "" {
+		log.Fatal("-client-ca needs -tls-cert and -tls-key")
+	}
+
+	// Reload the config on SIGHUP, keeping running sessions
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Printf("Certificate reload failed: %v", err)
+				}
+			}
+			conf, err := newConfig()
+			if err == nil {
+				err = server.Reload(conf)
+			}
+			if err != nil {
+				log.Printf("Reload failed: %v", err)
+				continue
+			}
+			log.Println("Reloaded config")
+		}
+	}()
+
+	addrs := []string{":" + strconv.Itoa(*port)}
+	if *listen != "" {
+		addrs = strings.Split(*listen, ",")
+	}
+
+	var listeners []*socks5.Listener
+	for _, addr := range addrs {
+		network := "tcp"
+		if strings.HasPrefix(addr, "unix:") {
+			network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *proxyProtocol != "" {
+			if l, err = socks5.NewProxyProtocolListener(l, strings.Split(*proxyProtocol, ",")...); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if tlsConf != nil {
+			l = socks5.NewTLSListener(l, tlsConf)
+		}
+		log.Printf("Start listening proxy service on %s\n", l.Addr())
+		listeners = append(listeners, &socks5.Listener{Listener: l})
+	}
+
 	log.Println("Route from ", socsk5conf.BindIP)
-	if err := server.ListenAndServe("tcp", ":"+strconv.Itoa(*port)); err != nil {
+	if err := server.ServeListeners(context.Background(), listeners...); err != nil {
 		log.Fatal(err)
 	}
 
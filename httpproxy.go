@@ -0,0 +1,454 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errHTTPProxyAuth the HTTP client sent no valid Proxy-Authorization
+	errHTTPProxyAuth = errors.New("HTTP proxy authentication failed")
+	// errHTTPMethod the HTTP client sent CONNECT after forward requests
+	errHTTPMethod = errors.New("unsupported HTTP proxy method")
+)
+
+// isHTTPMethodStart reports whether b may start an HTTP request line,
+// which no SOCKS version byte does
+func isHTTPMethodStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// readHTTPRequest reads an HTTP CONNECT request into a Request handled
+// like a SOCKS5 CONNECT, or the first request of an HTTP forward proxy
+// client. The client authenticates with Basic Proxy-Authorization
+// against the Credentials of the enabled UserPassAuthenticator, unless
+// "auth-less" mode or a client certificate authenticates it. The
+// returned context makes the session reply in HTTP.
+func (s *Server) readHTTPRequest(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) (context.Context, *Request, error) {
+	log := s.logger(ctx)
+	ctx = context.WithValue(ctx, replyFuncContextKey, replyFunc(sendHTTPReply))
+
+	setConnDeadline(conn, s.configFor(ctx).RequestTimeout)
+	httpReq, err := http.ReadRequest(bufConn)
+	if err != nil {
+		log.Warn("failed to read request", "error", err)
+		return ctx, nil, fmt.Errorf("failed to read HTTP request: %v", err)
+	}
+
+	sessionFromContext(ctx).setPhase(PhaseAuth)
+	authContext, err := s.authenticateHTTP(ctx, conn, httpReq)
+	if err != nil {
+		recordReply(ctx, ReplyRuleFailure)
+		if err := writeHTTPResponse(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n"); err != nil {
+			return ctx, nil, fmt.Errorf("failed to send reply: %v", err)
+		}
+		err = fmt.Errorf("failed to authenticate: %v", err)
+		log.Warn("authentication failed", "error", err)
+		return ctx, nil, err
+	}
+	ctx = context.WithValue(ctx, authContextContextKey, authContext)
+	sessionFromContext(ctx).setAuthContext(authContext)
+
+	// Forward proxy requests are checked one by one, the first one
+	// only sets the destination of the session
+	var dest *AddrSpec
+	if httpReq.Method == http.MethodConnect {
+		dest, err = parseHostPort(httpReq.RequestURI)
+	} else {
+		dest, err = httpForwardDest(httpReq)
+	}
+	if err != nil {
+		if err := sendSessionReply(ctx, conn, ReplyAddrTypeNotSupported, nil); err != nil {
+			return ctx, nil, fmt.Errorf("failed to send reply: %v", err)
+		}
+		log.Warn("failed to read request", "error", err)
+		return ctx, nil, fmt.Errorf("failed to read destination address: %v", err)
+	}
+
+	var forward *http.Request
+	if httpReq.Method != http.MethodConnect {
+		forward = httpReq
+	}
+	return ctx, &Request{
+		Version:     0,
+		Command:     CommandConnect,
+		AuthContext: authContext,
+		DestAddr:    dest,
+		BufConn:     bufConn,
+		httpRequest: forward,
+	}, nil
+}
+
+// authenticateHTTP authenticates the HTTP client of the session of ctx
+// with the auth methods enabled for it
+func (s *Server) authenticateHTTP(ctx context.Context, conn net.Conn, req *http.Request) (*AuthContext, error) {
+	methods := s.sessionAuthMethods(ctx)
+	metrics := s.configFor(ctx).Metrics
+
+	switch a := methods[AuthMethodNoAuth].(type) {
+	case NoAuthAuthenticator, *NoAuthAuthenticator:
+		return &AuthContext{AuthMethodNoAuth, nil}, nil
+	case interface {
+		authContext(w io.Writer) (*AuthContext, error)
+	}:
+		// TLSClientCertAuthenticator
+		if authContext, err := a.authContext(conn); err == nil {
+			metrics.authAttempt("client_cert", nil)
+			return authContext, nil
+		}
+	}
+
+	var creds CredentialStore
+	switch a := methods[AuthMethodUserPass].(type) {
+	case UserPassAuthenticator:
+		creds = a.Credentials
+	case *UserPassAuthenticator:
+		creds = a.Credentials
+	}
+	if creds == nil {
+		return nil, ErrNoSupportedAuth
+	}
+	user, password, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok || !creds.Valid(user, password) {
+		metrics.authAttempt("http_basic", errHTTPProxyAuth)
+		return nil, errHTTPProxyAuth
+	}
+	metrics.authAttempt("http_basic", nil)
+	return &AuthContext{AuthMethodUserPass, map[string]string{"Username": user}}, nil
+}
+
+// parseBasicAuth parses a Basic Proxy-Authorization header value
+func parseBasicAuth(auth string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// parseHostPort parses the host:port authority of a CONNECT request
+func parseHostPort(hostport string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: int(port)}, nil
+	}
+	if host == "" || len(host) > 255 {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+	return &AddrSpec{FQDN: host, Port: int(port)}, nil
+}
+
+// httpStatus maps a SOCKS5 reply code to an HTTP status
+func httpStatus(resp uint8) int {
+	switch resp {
+	case ReplySucceeded:
+		return http.StatusOK
+	case ReplyRuleFailure:
+		return http.StatusForbidden
+	case ReplyNetworkUnreachable, ReplyHostUnreachable, ReplyConnectionRefused:
+		return http.StatusBadGateway
+	case ReplyTTLExpired:
+		return http.StatusGatewayTimeout
+	case ReplyCommandNotSupported:
+		return http.StatusMethodNotAllowed
+	case ReplyAddrTypeNotSupported:
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+// sendHTTPReply is the HTTP replyFunc
+func sendHTTPReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	return writeHTTPResponse(w, httpStatus(resp), "")
+}
+
+// writeHTTPResponse writes a response without body. Failures close the
+// connection, success starts the tunnel.
+func writeHTTPResponse(w io.Writer, status int, header string) error {
+	var msg string
+	if status == http.StatusOK {
+		msg = "HTTP/1.1 200 Connection established\r\n" + header + "\r\n"
+	} else {
+		msg = fmt.Sprintf("HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status), header)
+	}
+	_, err := io.WriteString(w, msg)
+	return err
+}
+
+// httpForwardDest returns the destination of an absolute-URI request
+func httpForwardDest(req *http.Request) (*AddrSpec, error) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return nil, fmt.Errorf("not an absolute http URI: %q", req.RequestURI)
+	}
+	hostport := req.URL.Host
+	if req.URL.Port() == "" {
+		hostport = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	return parseHostPort(hostport)
+}
+
+// hopHeaders apply to a single connection, they are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers of h, including those
+// listed by its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// httpUpstream is the connection to the target of the last forwarded
+// request, kept alive for the next one to the same address
+type httpUpstream struct {
+	addr string
+	conn net.Conn
+	br   *bufio.Reader
+	done chan struct{}
+}
+
+// open dials addr unless already connected to it
+func (u *httpUpstream) open(ctx context.Context, s *Server, req *Request) error {
+	addr := req.realDestAddr.Address()
+	if u.conn != nil && u.addr == addr {
+		return nil
+	}
+	u.close()
+	conn, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := writeOutboundProxyHeader(ctx, conn, req); err != nil {
+		conn.Close()
+		return err
+	}
+	u.addr, u.conn, u.br, u.done = addr, conn, bufio.NewReader(conn), make(chan struct{})
+
+	// Unblock the relay once the session is cancelled
+	go func(conn net.Conn, done chan struct{}) {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}(conn, u.done)
+	return nil
+}
+
+func (u *httpUpstream) close() {
+	if u.conn != nil {
+		close(u.done)
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+// handleHTTPForward serves the requests of an HTTP forward proxy client
+// until it closes the connection. Every request goes through the
+// resolver, rewriter and rules like a CONNECT to its host.
+func (s *Server) handleHTTPForward(ctx context.Context, conn net.Conn, req *Request) error {
+	conf := s.configFor(ctx)
+	bufConn, ok := req.BufConn.(*bufio.Reader)
+	if !ok {
+		bufConn = bufio.NewReader(req.BufConn)
+	}
+	up := &httpUpstream{}
+	defer up.close()
+
+	// The first request was read with the session
+	httpReq := req.httpRequest
+	since := httpMark{at: sessionFromContext(ctx).start}
+	for {
+		keepAlive, err := s.forwardHTTPRequest(ctx, conn, httpReq, req.AuthContext, up, since)
+		if err != nil || !keepAlive {
+			return err
+		}
+
+		// Wait for the next request
+		since = markHTTPRequest(ctx)
+		setConnDeadline(conn, conf.IdleTimeout)
+		httpReq, err = http.ReadRequest(bufConn)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return ErrIdleTimeout
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read HTTP request: %v", err)
+		}
+		setConnDeadline(conn, 0)
+		conf.Metrics.request(CommandConnect)
+		if httpReq.Method == http.MethodConnect {
+			if err := sendSessionReply(ctx, conn, ReplyCommandNotSupported, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("%w: %s", errHTTPMethod, httpReq.Method)
+		}
+	}
+}
+
+// httpMark is the time and session traffic before reading a request
+type httpMark struct {
+	at       time.Time
+	up, down int64
+}
+
+func markHTTPRequest(ctx context.Context) httpMark {
+	up, down := sessionFromContext(ctx).bytes()
+	return httpMark{at: time.Now(), up: up, down: down}
+}
+
+// forwardHTTPRequest forwards a single request read after since and its
+// response, and writes its access record. It reports whether the client
+// connection can serve another request.
+func (s *Server) forwardHTTPRequest(ctx context.Context, conn net.Conn, httpReq *http.Request, authContext *AuthContext, up *httpUpstream, since httpMark) (keepAlive bool, err error) {
+	conf := s.configFor(ctx)
+	sess := sessionFromContext(ctx)
+	req := &Request{
+		Command:     CommandConnect,
+		AuthContext: authContext,
+		BufConn:     httpReq.Body,
+	}
+	status := 0
+	defer func() {
+		up1, down1 := sess.bytes()
+		rec := &AccessRecord{
+			SessionID: SessionIDFromContext(ctx),
+			Start:     since.at,
+			End:       time.Now(),
+			Client:    conn.RemoteAddr().String(),
+			Username:  authUsername(authContext),
+			Command:   "http",
+			Reply:     -1,
+			BytesUp:   up1 - since.up,
+			BytesDown: down1 - since.down,
+			Reason:    endReasonCompleted,
+			Method:    httpReq.Method,
+			Host:      httpReq.Host,
+			Status:    status,
+		}
+		if req.DestAddr != nil {
+			rec.DestAddr = req.DestAddr.String()
+		}
+		if req.realDestAddr != nil {
+			rec.RealDestAddr = req.realDestAddr.String()
+		}
+		if err != nil {
+			rec.Reason = err.Error()
+		}
+		s.writeAccessRecord(ctx, rec)
+	}()
+
+	// fail replies with resp, closing the client connection
+	fail := func(resp uint8, err error) (bool, error) {
+		status = httpStatus(resp)
+		if err := sendSessionReply(ctx, conn, resp, nil); err != nil {
+			return false, fmt.Errorf("failed to send reply: %v", err)
+		}
+		return false, err
+	}
+
+	if req.DestAddr, err = httpForwardDest(httpReq); err != nil {
+		return fail(ReplyAddrTypeNotSupported, err)
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	if ctx, err = s.resolveRequest(ctx, req); err != nil {
+		return fail(ReplyHostUnreachable, err)
+	}
+	var ok bool
+	if ctx, ok = conf.Rules.Allow(ctx, req); !ok {
+		return fail(ReplyRuleFailure, fmt.Errorf("request to %v blocked by rules", req.DestAddr))
+	}
+	if err := up.open(ctx, s, req); err != nil {
+		s.logger(ctx).Debug("dial failed", "real_dest", req.realDestAddr.String(), "error", err)
+		return fail(dialErrorReply(err), fmt.Errorf("connect to %v failed: %v", req.DestAddr, err))
+	}
+
+	// Forward the request, keeping the upstream connection alive
+	clientClose := httpReq.Close
+	removeHopHeaders(httpReq.Header)
+	if conf.HTTPProxyXForwardedFor {
+		if ip := clientIP(conn.RemoteAddr()); ip != "" {
+			if prior := httpReq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			httpReq.Header.Set("X-Forwarded-For", ip)
+		}
+	}
+	if conf.HTTPProxyVia != "" {
+		httpReq.Header.Add("Via", fmt.Sprintf("%d.%d %s", httpReq.ProtoMajor, httpReq.ProtoMinor, conf.HTTPProxyVia))
+	}
+	httpReq.Close = false
+	if err := httpReq.Write(up.conn); err != nil {
+		up.close()
+		return fail(ReplyHostUnreachable, fmt.Errorf("failed to forward request to %v: %v", req.DestAddr, err))
+	}
+	resp, err := http.ReadResponse(up.br, httpReq)
+	if err != nil {
+		up.close()
+		return fail(ReplyHostUnreachable, fmt.Errorf("failed to read response of %v: %v", req.DestAddr, err))
+	}
+	defer resp.Body.Close()
+	upstreamClose := resp.Close
+
+	// Relay the response, closing the client connection if it asked to
+	// or the length of the response is only told by closing it
+	removeHopHeaders(resp.Header)
+	if conf.HTTPProxyVia != "" {
+		resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, conf.HTTPProxyVia))
+	}
+	unknownLength := resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && httpReq.Method != http.MethodHead
+	resp.Close = clientClose || upstreamClose || unknownLength
+	status = resp.StatusCode
+	recordReply(ctx, ReplySucceeded)
+	sess.setPhase(PhaseRelaying)
+	if err := resp.Write(conn); err != nil {
+		up.close()
+		return false, fmt.Errorf("failed to relay response of %v: %v", req.DestAddr, err)
+	}
+	if upstreamClose {
+		up.close()
+	}
+	return !resp.Close, nil
+}
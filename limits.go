@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrTooManyConns the server wide session limit was reached
+	ErrTooManyConns = errors.New("too many concurrent sessions")
+	// ErrTooManyConnsPerIP the per client IP session limit was reached
+	ErrTooManyConnsPerIP = errors.New("too many concurrent sessions from client IP")
+	// ErrTooManyConnsPerUser the per user session limit was reached
+	ErrTooManyConnsPerUser = errors.New("too many concurrent sessions for user")
+	// ErrTooManyAssociationsPerUser the per user UDP association limit was reached
+	ErrTooManyAssociationsPerUser = errors.New("too many concurrent UDP associations for user")
+)
+
+// connLimits counts concurrent sessions against the Config maximums
+type connLimits struct {
+	mu           sync.Mutex
+	total        int
+	perIP        map[string]int
+	perUser      map[string]int
+	assocPerUser map[string]int
+}
+
+// acquireConn takes a server wide session slot
+func (l *connLimits) acquireConn(max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && l.total >= max {
+		return false
+	}
+	l.total++
+	return true
+}
+
+func (l *connLimits) releaseConn() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+}
+
+func (l *connLimits) acquireIP(ip string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return acquireKey(&l.perIP, ip, max)
+}
+
+func (l *connLimits) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	releaseKey(l.perIP, ip)
+}
+
+func (l *connLimits) acquireUser(user string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return acquireKey(&l.perUser, user, max)
+}
+
+func (l *connLimits) releaseUser(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	releaseKey(l.perUser, user)
+}
+
+func (l *connLimits) acquireAssociation(user string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return acquireKey(&l.assocPerUser, user, max)
+}
+
+func (l *connLimits) releaseAssociation(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	releaseKey(l.assocPerUser, user)
+}
+
+// acquireKey increments m[key] unless it already reached max (zero
+// meaning unlimited). l.mu must be held.
+func acquireKey(m *map[string]int, key string, max int) bool {
+	if *m == nil {
+		*m = make(map[string]int)
+	}
+	if max > 0 && (*m)[key] >= max {
+		return false
+	}
+	(*m)[key]++
+	return true
+}
+
+// releaseKey decrements m[key], dropping it once it reaches zero.
+// l.mu must be held.
+func releaseKey(m map[string]int, key string) {
+	if m[key] <= 1 {
+		delete(m, key)
+		return
+	}
+	m[key]--
+}
+
+// clientIP returns the IP of addr as a limits key, or "" when addr is
+// not an IP address (e.g. a unix socket peer)
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return ""
+}
+
+// addrSpecOf returns the IP and port of addr, or nil if it has none,
+// as a unix socket address
+func addrSpecOf(addr net.Addr) *AddrSpec {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}
+	case nil:
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &AddrSpec{IP: ip, Port: port}
+}
+
+// authUsername returns the username negotiated in authContext, if any
+func authUsername(authContext *AuthContext) string {
+	if authContext == nil {
+		return ""
+	}
+	return authContext.Payload["Username"]
+}
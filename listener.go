@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"codeberg.org/peterzam/socks5/bandwidth"
+)
+
+// Listener is a net.Listener served by ServeListeners, along with
+// optional overrides of the Config for the sessions it accepts. All
+// listeners of a Server share its session registry, limits and shutdown.
+type Listener struct {
+	net.Listener
+
+	// Bandwidth overrides Config.Bandwidth for this listener
+	Bandwidth *bandwidth.ListenerConfig
+
+	// AuthMethods overrides Config.AuthMethods for this listener
+	AuthMethods []Authenticator
+
+	// BindIP overrides Config.BindIP for this listener
+	BindIP net.IP
+
+	// UDPRelayIP overrides Config.UDPRelayIP for this listener
+	UDPRelayIP net.IP
+
+	// Deprecated: every UDP association gets its own relay socket,
+	// BindPort is ignored.
+	BindPort int
+}
+
+// listenerState holds the overrides of a Listener, applied over the
+// Config current when a session starts
+type listenerState struct {
+	authMethods map[uint8]Authenticator
+	bindIP      net.IP
+	udpRelayIP  net.IP
+}
+
+// listenerContextKey carries the *listenerState a session was accepted on
+var listenerContextKey = &contextKey{"listener"}
+
+func listenerFromContext(ctx context.Context) *listenerState {
+	ls, _ := ctx.Value(listenerContextKey).(*listenerState)
+	return ls
+}
+
+func newListenerState(ln *Listener) *listenerState {
+	ls := &listenerState{
+		bindIP:     ln.BindIP,
+		udpRelayIP: ln.UDPRelayIP,
+	}
+	if len(ln.AuthMethods) > 0 {
+		ls.authMethods = authMethodsByCode(ln.AuthMethods)
+	}
+	return ls
+}
+
+// sessionAuthMethods returns the auth methods enabled for the listener
+// the session of ctx was accepted on
+func (s *Server) sessionAuthMethods(ctx context.Context) map[uint8]Authenticator {
+	if ls := listenerFromContext(ctx); ls != nil && ls.authMethods != nil {
+		return ls.authMethods
+	}
+	return s.configFor(ctx).authMethods
+}
+
+// ServeListeners serves every listener concurrently until all of them
+// return. If one fails, the others are closed and its error is returned.
+// After Shutdown or Close, the returned error is ErrServerClosed.
+func (s *Server) ServeListeners(ctx context.Context, listeners ...*Listener) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		stop     = make(chan struct{})
+	)
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln *Listener) {
+			defer wg.Done()
+			if err := s.serveListener(ctx, ln, stop); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					close(stop)
+				})
+			}
+		}(ln)
+	}
+	wg.Wait()
+	return firstErr
+}
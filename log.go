@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// StructuredLogger is a leveled logger taking a message followed by
+// alternating key/value pairs. A *slog.Logger satisfies it as is.
+type StructuredLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// printfLogger adapts an ErrorLogger to StructuredLogger, rendering the
+// pairs as key=value. Debug lines are dropped, as the plain logger used
+// to only report failures.
+type printfLogger struct {
+	ErrorLogger
+}
+
+// NewPrintfLogger returns a StructuredLogger writing to l in a
+// level=... msg=... key=value format. Debug lines are dropped.
+func NewPrintfLogger(l ErrorLogger) StructuredLogger {
+	return printfLogger{l}
+}
+
+func (l printfLogger) Debug(msg string, args ...interface{}) {}
+
+func (l printfLogger) Info(msg string, args ...interface{}) {
+	l.output("info", msg, args)
+}
+
+func (l printfLogger) Warn(msg string, args ...interface{}) {
+	l.output("warn", msg, args)
+}
+
+func (l printfLogger) Error(msg string, args ...interface{}) {
+	l.output("error", msg, args)
+}
+
+func (l printfLogger) output(level, msg string, args []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "socks: level=%s msg=%q", level, msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%s", quoteValue(args[i]))
+			break
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], quoteValue(args[i+1]))
+	}
+	l.Printf("%s", b.String())
+}
+
+func quoteValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// sessionLogger prepends the fields of a session to every line
+type sessionLogger struct {
+	StructuredLogger
+	sess *session
+}
+
+func (l sessionLogger) Debug(msg string, args ...interface{}) {
+	l.StructuredLogger.Debug(msg, append(l.sess.logFields(), args...)...)
+}
+
+func (l sessionLogger) Info(msg string, args ...interface{}) {
+	l.StructuredLogger.Info(msg, append(l.sess.logFields(), args...)...)
+}
+
+func (l sessionLogger) Warn(msg string, args ...interface{}) {
+	l.StructuredLogger.Warn(msg, append(l.sess.logFields(), args...)...)
+}
+
+func (l sessionLogger) Error(msg string, args ...interface{}) {
+	l.StructuredLogger.Error(msg, append(l.sess.logFields(), args...)...)
+}
+
+// fieldLogger prepends fixed fields to every line
+type fieldLogger struct {
+	StructuredLogger
+	fields []interface{}
+}
+
+func (l fieldLogger) Debug(msg string, args ...interface{}) {
+	l.StructuredLogger.Debug(msg, append(l.fields[:len(l.fields):len(l.fields)], args...)...)
+}
+
+func (l fieldLogger) Info(msg string, args ...interface{}) {
+	l.StructuredLogger.Info(msg, append(l.fields[:len(l.fields):len(l.fields)], args...)...)
+}
+
+func (l fieldLogger) Warn(msg string, args ...interface{}) {
+	l.StructuredLogger.Warn(msg, append(l.fields[:len(l.fields):len(l.fields)], args...)...)
+}
+
+func (l fieldLogger) Error(msg string, args ...interface{}) {
+	l.StructuredLogger.Error(msg, append(l.fields[:len(l.fields):len(l.fields)], args...)...)
+}
+
+// logger returns the logger for ctx, carrying the session fields when
+// ctx belongs to a session
+func (s *Server) logger(ctx context.Context) StructuredLogger {
+	l := s.configFor(ctx).logger
+	if sess := sessionFromContext(ctx); sess != nil {
+		return sessionLogger{l, sess}
+	}
+	if client := ClientAddrFromContext(ctx); client != nil {
+		return fieldLogger{l, []interface{}{"client", client.String()}}
+	}
+	return l
+}
+
+// commandName returns a readable name of a request command
+func commandName(cmd uint8) string {
+	switch cmd {
+	case CommandConnect:
+		return "connect"
+	case CommandBind:
+		return "bind"
+	case CommandAssociate:
+		return "associate"
+	case CommandUDPOverTCP:
+		return "udp-over-tcp"
+	}
+	return fmt.Sprintf("cmd-%d", cmd)
+}
@@ -0,0 +1,325 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLatencyBuckets are the upper bounds in seconds of the latency
+// histograms
+var defaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counters of a Server and writes them in the
+// Prometheus text exposition format. Set it as Config.Metrics and
+// serve it over HTTP, it implements http.Handler. The zero value is
+// ready to use, a nil *Metrics collects nothing.
+type Metrics struct {
+	// accessed atomically, kept first for 64-bit alignment
+	sessionsAccepted  int64
+	sessionsActive    int64
+	bytesUp           int64
+	bytesDown         int64
+	udpRelayed        int64
+	udpDropped        int64
+	udpBlocked        int64
+	dnsFailures       int64
+	bandwidthWaitUp   int64 // nanoseconds
+	bandwidthWaitDown int64 // nanoseconds
+
+	mu           sync.Mutex
+	authAttempts map[string]int64
+	authFailures map[string]int64
+	requests     map[string]int64
+	replies      map[uint8]int64
+	reassemblies map[string]int64
+	dialLatency  *histogram
+	dnsLatency   *histogram
+}
+
+// NewMetrics returns an empty Metrics, like &Metrics{}
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.initLocked()
+	return m
+}
+
+// initLocked makes the labeled counters and histograms of a zero
+// Metrics on first use. m.mu must be held.
+func (m *Metrics) initLocked() {
+	if m.requests != nil {
+		return
+	}
+	m.authAttempts = make(map[string]int64)
+	m.authFailures = make(map[string]int64)
+	m.requests = make(map[string]int64)
+	m.replies = make(map[uint8]int64)
+	m.reassemblies = make(map[string]int64)
+	m.dialLatency = newHistogram(defaultLatencyBuckets)
+	m.dnsLatency = newHistogram(defaultLatencyBuckets)
+}
+
+// metricsFromContext returns the Metrics configured for the session of
+// ctx, or nil
+func metricsFromContext(ctx context.Context) *Metrics {
+	if sc, ok := ctx.Value(configContextKey).(*serverConfig); ok {
+		return sc.Metrics
+	}
+	return nil
+}
+
+func (m *Metrics) sessionStarted() {
+	if m != nil {
+		atomic.AddInt64(&m.sessionsAccepted, 1)
+		atomic.AddInt64(&m.sessionsActive, 1)
+	}
+}
+
+func (m *Metrics) sessionEnded() {
+	if m != nil {
+		atomic.AddInt64(&m.sessionsActive, -1)
+	}
+}
+
+func (m *Metrics) authAttempt(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.authAttempts[method]++
+	if err != nil {
+		m.authFailures[method]++
+	}
+	m.mu.Unlock()
+}
+
+func (m *Metrics) request(cmd uint8) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.requests[commandName(cmd)]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) reply(resp uint8) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.replies[resp]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) dialed(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.dialLatency.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *Metrics) resolved(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&m.dnsFailures, 1)
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.dnsLatency.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *Metrics) addBytesUp(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.bytesUp, int64(n))
+	}
+}
+
+func (m *Metrics) addBytesDown(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.bytesDown, int64(n))
+	}
+}
+
+func (m *Metrics) udpDatagram(err error) {
+	if m == nil {
+		return
+	}
+	if errors.Is(err, errUDPDenied) {
+		atomic.AddInt64(&m.udpBlocked, 1)
+	} else if err != nil {
+		atomic.AddInt64(&m.udpDropped, 1)
+	} else {
+		atomic.AddInt64(&m.udpRelayed, 1)
+	}
+}
+
+// udpReassembly counts a completed or abandoned reassembly of a
+// fragmented datagram
+func (m *Metrics) udpReassembly(result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.initLocked()
+	m.reassemblies[result]++
+	m.mu.Unlock()
+}
+
+// bandwidthWait accounts time spent waiting on the bandwidth limiters,
+// read is the client to server direction
+func (m *Metrics) bandwidthWait(read bool, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if read {
+		atomic.AddInt64(&m.bandwidthWaitUp, int64(d))
+	} else {
+		atomic.AddInt64(&m.bandwidthWaitDown, int64(d))
+	}
+}
+
+// ServeHTTP writes the metrics, implementation of http.Handler
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition
+// format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	cw := &countingWriter{w: w}
+	b := bufio.NewWriter(cw)
+
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	header := func(name, typ, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	labeled := func(name, label string, values map[string]int64) {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(b, "%s{%s=%q} %d\n", name, label, k, values[k])
+		}
+	}
+
+	counter("socks5_sessions_accepted_total", "Sessions accepted.", atomic.LoadInt64(&m.sessionsAccepted))
+	header("socks5_sessions_active", "gauge", "Sessions currently served.")
+	fmt.Fprintf(b, "socks5_sessions_active %d\n", atomic.LoadInt64(&m.sessionsActive))
+
+	header("socks5_bytes_relayed_total", "counter", "Bytes relayed by direction, up is from the clients.")
+	fmt.Fprintf(b, "socks5_bytes_relayed_total{direction=\"up\"} %d\n", atomic.LoadInt64(&m.bytesUp))
+	fmt.Fprintf(b, "socks5_bytes_relayed_total{direction=\"down\"} %d\n", atomic.LoadInt64(&m.bytesDown))
+
+	header("socks5_udp_datagrams_total", "counter", "UDP datagrams from the clients by result.")
+	fmt.Fprintf(b, "socks5_udp_datagrams_total{result=\"relayed\"} %d\n", atomic.LoadInt64(&m.udpRelayed))
+	fmt.Fprintf(b, "socks5_udp_datagrams_total{result=\"dropped\"} %d\n", atomic.LoadInt64(&m.udpDropped))
+	fmt.Fprintf(b, "socks5_udp_datagrams_total{result=\"blocked\"} %d\n", atomic.LoadInt64(&m.udpBlocked))
+
+	header("socks5_bandwidth_wait_seconds_total", "counter", "Time spent waiting on bandwidth limiters by direction.")
+	fmt.Fprintf(b, "socks5_bandwidth_wait_seconds_total{direction=\"up\"} %s\n", formatFloat(time.Duration(atomic.LoadInt64(&m.bandwidthWaitUp)).Seconds()))
+	fmt.Fprintf(b, "socks5_bandwidth_wait_seconds_total{direction=\"down\"} %s\n", formatFloat(time.Duration(atomic.LoadInt64(&m.bandwidthWaitDown)).Seconds()))
+
+	counter("socks5_dns_failures_total", "Failed name resolutions.", atomic.LoadInt64(&m.dnsFailures))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initLocked()
+
+	header("socks5_auth_attempts_total", "counter", "Authentication attempts by method.")
+	labeled("socks5_auth_attempts_total", "method", m.authAttempts)
+	header("socks5_auth_failures_total", "counter", "Failed authentications by method.")
+	labeled("socks5_auth_failures_total", "method", m.authFailures)
+	header("socks5_requests_total", "counter", "Requests by command.")
+	labeled("socks5_requests_total", "command", m.requests)
+
+	header("socks5_udp_reassemblies_total", "counter", "Reassemblies of fragmented UDP datagrams by result.")
+	labeled("socks5_udp_reassemblies_total", "result", m.reassemblies)
+
+	header("socks5_replies_total", "counter", "Replies sent by code.")
+	codes := make([]int, 0, len(m.replies))
+	for code := range m.replies {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(b, "socks5_replies_total{code=\"%d\"} %d\n", code, m.replies[uint8(code)])
+	}
+
+	header("socks5_dial_duration_seconds", "histogram", "Latency of dialing destinations.")
+	m.dialLatency.write(b, "socks5_dial_duration_seconds")
+	header("socks5_dns_duration_seconds", "histogram", "Latency of name resolutions.")
+	m.dnsLatency.write(b, "socks5_dns_duration_seconds")
+
+	err := b.Flush()
+	return cw.n, err
+}
+
+// histogram is a cumulative Prometheus histogram, guarded by the mutex
+// of its Metrics
+type histogram struct {
+	bounds []float64
+	counts []int64 // per bucket, not cumulative, the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,498 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*********************************************************
+    PROXY protocol v2 header, see
+    https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+    +-----------+---------+--------+-----+-----------+------+
+    | SIGNATURE | VER/CMD | FAM/TP | LEN | ADDRESSES | TLVs |
+    +-----------+---------+--------+-----+-----------+------+
+    |    12     |    1    |   1    |  2  | Variable  | Var. |
+    +-----------+---------+--------+-----+-----------+------+
+**********************************************************/
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types
+const (
+	ProxyTLVALPN      = uint8(0x01)
+	ProxyTLVAuthority = uint8(0x02)
+	ProxyTLVCRC32C    = uint8(0x03)
+	ProxyTLVNoop      = uint8(0x04)
+	ProxyTLVUniqueID  = uint8(0x05)
+	ProxyTLVSSL       = uint8(0x20)
+	ProxyTLVNetNS     = uint8(0x30)
+
+	// ProxyTLVUsername carries the authenticated SOCKS username in the
+	// headers written to targets, from the custom range 0xE0-0xEF
+	ProxyTLVUsername = uint8(0xE0)
+)
+
+const (
+	// proxyV1MaxLen is the longest v1 header, CRLF included
+	proxyV1MaxLen = 107
+	// defaultProxyHeaderTimeout bounds reading a header when
+	// ProxyProtocolListener.HeaderTimeout is zero
+	defaultProxyHeaderTimeout = 10 * time.Second
+)
+
+var (
+	// ErrProxyHeaderMissing a trusted source sent no PROXY header
+	ErrProxyHeaderMissing = errors.New("missing PROXY protocol header")
+	// ErrProxyHeaderInvalid the PROXY header could not be parsed
+	ErrProxyHeaderInvalid = errors.New("invalid PROXY protocol header")
+)
+
+// ProxyTLV is a type-length-value extension of a PROXY v2 header
+type ProxyTLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header
+type ProxyHeader struct {
+	// Version is 1 (text) or 2 (binary)
+	Version int
+	// Local is set for the LOCAL command (v2) and UNKNOWN family (v1),
+	// in which case the connection addresses are kept
+	Local bool
+	// SourceAddr is the address of the client
+	SourceAddr net.Addr
+	// DestAddr is the address the client connected to
+	DestAddr net.Addr
+	// TLVs are the v2 extensions, in order
+	TLVs []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of type typ
+func (h *ProxyHeader) TLV(typ uint8) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// proxyHeaderContextKey carries the *ProxyHeader of a session
+var proxyHeaderContextKey = &contextKey{"proxy-header"}
+
+// ProxyHeaderFromContext returns the PROXY protocol header received for
+// the session ctx belongs to, or nil.
+func ProxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	hdr, _ := ctx.Value(proxyHeaderContextKey).(*ProxyHeader)
+	return hdr
+}
+
+// ProxyProtocolListener accepts connections that start with a PROXY
+// protocol v1 or v2 header, as sent by HAProxy and most L4 load
+// balancers, and reports the client address it carries as RemoteAddr.
+// Only connections from TrustedSources are expected to send a header,
+// others are passed through as is.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// TrustedSources are the networks of the load balancers. A
+	// connection from them without a valid header is refused.
+	TrustedSources []*net.IPNet
+
+	// HeaderTimeout bounds reading the header. Defaults to 10s.
+	HeaderTimeout time.Duration
+}
+
+// NewProxyProtocolListener wraps l, trusting the sources in the given
+// CIDR notations (e.g. "10.0.0.0/8") to send a PROXY header
+func NewProxyProtocolListener(l net.Listener, trusted ...string) (*ProxyProtocolListener, error) {
+	pl := &ProxyProtocolListener{Listener: l}
+	for _, cidr := range trusted {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		pl.TrustedSources = append(pl.TrustedSources, ipnet)
+	}
+	return pl, nil
+}
+
+// Accept implementation of net.Listener. The header is read lazily by
+// the returned connection, so a slow client does not block Accept.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	return &ProxyProtocolConn{Conn: conn, timeout: timeout}, nil
+}
+
+func (l *ProxyProtocolListener) trusted(addr net.Addr) bool {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range l.TrustedSources {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyProtocolConn is a connection from a trusted source accepted by a
+// ProxyProtocolListener
+type ProxyProtocolConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	r      *bufio.Reader
+	header *ProxyHeader
+	err    error
+}
+
+// ProxyHeader reads the header on first use and returns it
+func (c *ProxyProtocolConn) ProxyHeader() (*ProxyHeader, error) {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.header, c.err
+}
+
+// Read reads the data following the header
+func (c *ProxyProtocolConn) Read(b []byte) (int, error) {
+	if _, err := c.ProxyHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, or the address
+// of the connection if none applies
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	if hdr, err := c.ProxyHeader(); err == nil && !hdr.Local && hdr.SourceAddr != nil {
+		return hdr.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to according to
+// the header, or the address of the connection if none applies
+func (c *ProxyProtocolConn) LocalAddr() net.Addr {
+	if hdr, err := c.ProxyHeader(); err == nil && !hdr.Local && hdr.DestAddr != nil {
+		return hdr.DestAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the underlying connection
+func (c *ProxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// WriteTo writes the header in its Version format. TLVs are only sent
+// in version 2. Addresses of different or unknown families are sent as
+// UNKNOWN (v1) or AF_UNSPEC (v2).
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	var b []byte
+	switch h.Version {
+	case 1:
+		b = h.appendV1(nil)
+	case 2:
+		b = h.appendV2(nil)
+	default:
+		return 0, fmt.Errorf("unsupported PROXY protocol version: %d", h.Version)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// proxyIPs returns the source and destination IPs and ports of h and
+// whether both are IPv4, or ok false if they can't be sent
+func (h *ProxyHeader) proxyIPs() (src, dst *net.TCPAddr, v4 bool, ok bool) {
+	if h.Local {
+		return nil, nil, false, false
+	}
+	src, dst = tcpAddrOf(h.SourceAddr), tcpAddrOf(h.DestAddr)
+	if src == nil || dst == nil {
+		return nil, nil, false, false
+	}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return src, dst, true, true
+	}
+	if src.IP.To4() == nil && dst.IP.To4() == nil && src.IP.To16() != nil && dst.IP.To16() != nil {
+		return src, dst, false, true
+	}
+	return nil, nil, false, false
+}
+
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+	return nil
+}
+
+func (h *ProxyHeader) appendV1(b []byte) []byte {
+	src, dst, v4, ok := h.proxyIPs()
+	if !ok {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	proto := "TCP6"
+	if v4 {
+		proto = "TCP4"
+	}
+	return append(b, fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port)...)
+}
+
+func (h *ProxyHeader) appendV2(b []byte) []byte {
+	b = append(b, proxyV2Signature...)
+	command := byte(0x21) // version 2, PROXY
+	if h.Local {
+		command = 0x20
+	}
+	var addrs []byte
+	family := byte(0x00) // AF_UNSPEC
+	if src, dst, v4, ok := h.proxyIPs(); ok {
+		if v4 {
+			family = 0x11 // AF_INET, STREAM
+			addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+		} else {
+			family = 0x21 // AF_INET6, STREAM
+			addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+		}
+		addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+	for _, tlv := range h.TLVs {
+		addrs = append(addrs, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		addrs = append(addrs, tlv.Value...)
+	}
+	b = append(b, command, family, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(b, addrs...)
+}
+
+// outboundProxyHeaderContextKey carries the PROXY protocol version to
+// write on the target connection
+var outboundProxyHeaderContextKey = &contextKey{"outbound-proxy-header"}
+
+// WithOutboundProxyHeader returns a copy of ctx asking the server to
+// start the target connection of a CONNECT with a PROXY protocol header
+// of the given version (1 or 2), carrying the SOCKS client address and,
+// in version 2, the username as a ProxyTLVUsername TLV. Return it from
+// a RuleSet or an AddressRewriter to enable it per destination.
+func WithOutboundProxyHeader(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, outboundProxyHeaderContextKey, version)
+}
+
+// writeOutboundProxyHeader writes the PROXY header requested on ctx, if
+// any, announcing the client of req to target
+func writeOutboundProxyHeader(ctx context.Context, target net.Conn, req *Request) error {
+	version, _ := ctx.Value(outboundProxyHeaderContextKey).(int)
+	if version == 0 {
+		return nil
+	}
+	hdr := &ProxyHeader{
+		Version:    version,
+		SourceAddr: ClientAddrFromContext(ctx),
+		DestAddr:   target.RemoteAddr(),
+	}
+	if user := authUsername(req.AuthContext); user != "" {
+		hdr.TLVs = append(hdr.TLVs, ProxyTLV{Type: ProxyTLVUsername, Value: []byte(user)})
+	}
+	_, err := hdr.WriteTo(target)
+	return err
+}
+
+// proxyProtocolConnOf finds a *ProxyProtocolConn among the connections
+// wrapped by conn
+func proxyProtocolConnOf(conn net.Conn) *ProxyProtocolConn {
+	pc, _ := findConn(conn, func(c net.Conn) bool {
+		_, ok := c.(*ProxyProtocolConn)
+		return ok
+	}).(*ProxyProtocolConn)
+	return pc
+}
+
+// readProxyHeader reads a v1 or v2 header from r
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if string(sig[:6]) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, ErrProxyHeaderMissing
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line too long", ErrProxyHeaderInvalid)
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	hdr := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		hdr.Local = true
+		return hdr, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeaderInvalid, line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeaderInvalid, line)
+	}
+	hdr.SourceAddr = &net.TCPAddr{IP: src, Port: int(sport)}
+	hdr.DestAddr = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return hdr, nil
+}
+
+// readProxyHeaderV2 parses a binary header
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrProxyHeaderInvalid, fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	hdr := &ProxyHeader{Version: 2}
+	switch fixed[12] & 0x0f {
+	case 0x0: // LOCAL
+		hdr.Local = true
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: command %d", ErrProxyHeaderInvalid, fixed[12]&0x0f)
+	}
+
+	// Addresses, by family and transport
+	var addrLen int
+	family, transport := fixed[13]>>4, fixed[13]&0x0f
+	switch family {
+	case 0x0: // AF_UNSPEC
+		hdr.Local = true
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("%w: family %d", ErrProxyHeaderInvalid, family)
+	}
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("%w: short addresses", ErrProxyHeaderInvalid)
+	}
+	addrs := payload[:addrLen]
+	switch family {
+	case 0x1, 0x2:
+		ipLen := addrLen/2 - 2
+		src := net.IP(append([]byte(nil), addrs[:ipLen]...))
+		dst := net.IP(append([]byte(nil), addrs[ipLen:2*ipLen]...))
+		sport := int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+		dport := int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+		if transport == 0x2 {
+			hdr.SourceAddr = &net.UDPAddr{IP: src, Port: sport}
+			hdr.DestAddr = &net.UDPAddr{IP: dst, Port: dport}
+		} else {
+			hdr.SourceAddr = &net.TCPAddr{IP: src, Port: sport}
+			hdr.DestAddr = &net.TCPAddr{IP: dst, Port: dport}
+		}
+	case 0x3:
+		hdr.SourceAddr = &net.UnixAddr{Name: unixPath(addrs[:108]), Net: "unix"}
+		hdr.DestAddr = &net.UnixAddr{Name: unixPath(addrs[108:]), Net: "unix"}
+	}
+
+	// TLVs
+	for tlvs := payload[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: short TLV", ErrProxyHeaderInvalid)
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("%w: short TLV", ErrProxyHeaderInvalid)
+		}
+		hdr.TLVs = append(hdr.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+
+	if sum, ok := hdr.TLV(ProxyTLVCRC32C); ok {
+		if !validProxyChecksum(fixed, payload, sum) {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrProxyHeaderInvalid)
+		}
+	}
+	return hdr, nil
+}
+
+// validProxyChecksum checks the CRC32C of a v2 header, computed with
+// the checksum field itself zeroed
+func validProxyChecksum(fixed, payload, sum []byte) bool {
+	if len(sum) != 4 {
+		return false
+	}
+	want := binary.BigEndian.Uint32(sum)
+	for i := range sum {
+		sum[i] = 0
+	}
+	table := crc32.MakeTable(crc32.Castagnoli)
+	got := crc32.Update(crc32.Checksum(fixed, table), table, payload)
+	binary.BigEndian.PutUint32(sum, want)
+	return got == want
+}
+
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
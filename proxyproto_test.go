@@ -0,0 +1,320 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header of command and family around payload
+func proxyV2(command, family byte, payload []byte) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, command, family, byte(len(payload)>>8), byte(len(payload)))
+	return append(b, payload...)
+}
+
+// proxyV2IPv4 is the address block of 10.0.0.1:1000 -> 10.0.0.2:2000
+var proxyV2IPv4 = []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x03, 0xe8, 0x07, 0xd0}
+
+// withProxyChecksum appends a CRC32C TLV to the v2 header b and fills
+// it in, or fills in bad if non nil
+func withProxyChecksum(b []byte, bad []byte) []byte {
+	b = append(b, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-16))
+	sum := bad
+	if sum == nil {
+		sum = make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+	}
+	copy(b[len(b)-4:], sum)
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	unixAddrs := make([]byte, 216)
+	copy(unixAddrs, "/run/src.sock")
+	copy(unixAddrs[108:], "/run/dst.sock")
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    *ProxyHeader
+		wantErr error
+	}{
+		{
+			name:  "v1 tcp4",
+			input: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1000 2000\r\n"),
+			want: &ProxyHeader{
+				Version:    1,
+				SourceAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000},
+				DestAddr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2000},
+			},
+		},
+		{
+			name:  "v1 tcp6",
+			input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1000 2000\r\n"),
+			want: &ProxyHeader{
+				Version:    1,
+				SourceAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+				DestAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2000},
+			},
+		},
+		{
+			name:  "v1 unknown",
+			input: []byte("PROXY UNKNOWN ignored\r\n"),
+			want:  &ProxyHeader{Version: 1, Local: true},
+		},
+		{
+			name:    "v1 bad protocol",
+			input:   []byte("PROXY UDP4 192.0.2.1 192.0.2.2 1000 2000\r\n"),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v1 bad address",
+			input:   []byte("PROXY TCP4 192.0.2.x 192.0.2.2 1000 2000\r\n"),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v1 port out of range",
+			input:   []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 2000\r\n"),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v1 missing field",
+			input:   []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1000\r\n"),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v1 no CR",
+			input:   []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1000 2000\n"),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v1 line too long",
+			input:   []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n"),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v1 truncated",
+			input:   []byte("PROXY TCP4 192.0.2.1"),
+			wantErr: io.EOF,
+		},
+		{
+			name:  "v2 tcp4",
+			input: proxyV2(0x21, 0x11, proxyV2IPv4),
+			want: &ProxyHeader{
+				Version:    2,
+				SourceAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+				DestAddr:   &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000},
+			},
+		},
+		{
+			name:  "v2 udp4",
+			input: proxyV2(0x21, 0x12, proxyV2IPv4),
+			want: &ProxyHeader{
+				Version:    2,
+				SourceAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+				DestAddr:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000},
+			},
+		},
+		{
+			name: "v2 tcp6",
+			input: proxyV2(0x21, 0x21, append(append(
+				net.ParseIP("2001:db8::1").To16(),
+				net.ParseIP("2001:db8::2").To16()...),
+				0x03, 0xe8, 0x07, 0xd0)),
+			want: &ProxyHeader{
+				Version:    2,
+				SourceAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+				DestAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2000},
+			},
+		},
+		{
+			name:  "v2 unix",
+			input: proxyV2(0x21, 0x31, unixAddrs),
+			want: &ProxyHeader{
+				Version:    2,
+				SourceAddr: &net.UnixAddr{Name: "/run/src.sock", Net: "unix"},
+				DestAddr:   &net.UnixAddr{Name: "/run/dst.sock", Net: "unix"},
+			},
+		},
+		{
+			name:  "v2 local",
+			input: proxyV2(0x20, 0x00, nil),
+			want:  &ProxyHeader{Version: 2, Local: true},
+		},
+		{
+			name:  "v2 tlvs",
+			input: proxyV2(0x21, 0x11, append(append([]byte(nil), proxyV2IPv4...), ProxyTLVAuthority, 0, 3, 'a', '.', 'b', ProxyTLVNoop, 0, 0)),
+			want: &ProxyHeader{
+				Version:    2,
+				SourceAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+				DestAddr:   &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000},
+				TLVs: []ProxyTLV{
+					{Type: ProxyTLVAuthority, Value: []byte("a.b")},
+					{Type: ProxyTLVNoop, Value: []byte{}},
+				},
+			},
+		},
+		{
+			name:  "v2 valid checksum",
+			input: withProxyChecksum(proxyV2(0x21, 0x11, proxyV2IPv4), nil),
+			want: &ProxyHeader{
+				Version:    2,
+				SourceAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+				DestAddr:   &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000},
+				TLVs:       []ProxyTLV{{Type: ProxyTLVCRC32C}},
+			},
+		},
+		{
+			name:    "v2 bad checksum",
+			input:   withProxyChecksum(proxyV2(0x21, 0x11, proxyV2IPv4), []byte{1, 2, 3, 4}),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 short checksum",
+			input:   proxyV2(0x21, 0x11, append(append([]byte(nil), proxyV2IPv4...), ProxyTLVCRC32C, 0, 2, 0, 0)),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 bad version",
+			input:   proxyV2(0x11, 0x11, proxyV2IPv4),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 bad command",
+			input:   proxyV2(0x22, 0x11, proxyV2IPv4),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 bad family",
+			input:   proxyV2(0x21, 0x41, proxyV2IPv4),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 short addresses",
+			input:   proxyV2(0x21, 0x21, proxyV2IPv4),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 short TLV header",
+			input:   proxyV2(0x21, 0x11, append(append([]byte(nil), proxyV2IPv4...), ProxyTLVNoop, 0)),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 TLV past the end",
+			input:   proxyV2(0x21, 0x11, append(append([]byte(nil), proxyV2IPv4...), ProxyTLVNoop, 0, 5, 1)),
+			wantErr: ErrProxyHeaderInvalid,
+		},
+		{
+			name:    "v2 truncated fixed header",
+			input:   proxyV2(0x21, 0x11, proxyV2IPv4)[:14],
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "v2 truncated payload",
+			input:   proxyV2(0x21, 0x11, proxyV2IPv4)[:20],
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "missing",
+			input:   []byte("\x05\x01\x00 not a PROXY header"),
+			wantErr: ErrProxyHeaderMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hdr.Version != tt.want.Version || hdr.Local != tt.want.Local {
+				t.Fatalf("got version %d local %v, want %d %v", hdr.Version, hdr.Local, tt.want.Version, tt.want.Local)
+			}
+			if !sameAddr(hdr.SourceAddr, tt.want.SourceAddr) || !sameAddr(hdr.DestAddr, tt.want.DestAddr) {
+				t.Fatalf("got %v -> %v, want %v -> %v", hdr.SourceAddr, hdr.DestAddr, tt.want.SourceAddr, tt.want.DestAddr)
+			}
+			if len(hdr.TLVs) != len(tt.want.TLVs) {
+				t.Fatalf("got %d TLVs, want %d", len(hdr.TLVs), len(tt.want.TLVs))
+			}
+			for i, tlv := range tt.want.TLVs {
+				if hdr.TLVs[i].Type != tlv.Type {
+					t.Fatalf("TLV %d type = %#x, want %#x", i, hdr.TLVs[i].Type, tlv.Type)
+				}
+				if tlv.Type != ProxyTLVCRC32C && !bytes.Equal(hdr.TLVs[i].Value, tlv.Value) {
+					t.Fatalf("TLV %d value = %q, want %q", i, hdr.TLVs[i].Value, tlv.Value)
+				}
+			}
+		})
+	}
+}
+
+// sameAddr compares addresses by type and value
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		b, ok := b.(*net.TCPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Port == b.Port
+	case *net.UDPAddr:
+		b, ok := b.(*net.UDPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Port == b.Port
+	case *net.UnixAddr:
+		b, ok := b.(*net.UnixAddr)
+		return ok && *a == *b
+	}
+	return false
+}
+
+func TestValidProxyChecksumRestoresField(t *testing.T) {
+	b := withProxyChecksum(proxyV2(0x21, 0x11, proxyV2IPv4), nil)
+	sum := append([]byte(nil), b[len(b)-4:]...)
+	if !validProxyChecksum(b[:16], b[16:], b[len(b)-4:]) {
+		t.Fatal("valid checksum rejected")
+	}
+	if !bytes.Equal(b[len(b)-4:], sum) {
+		t.Fatalf("checksum field = %x after the check, want %x", b[len(b)-4:], sum)
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		in := &ProxyHeader{
+			Version:    version,
+			SourceAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+			DestAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2000},
+		}
+		if version == 2 {
+			in.TLVs = []ProxyTLV{{Type: ProxyTLVUsername, Value: []byte("user")}}
+		}
+		var buf bytes.Buffer
+		if _, err := in.WriteTo(&buf); err != nil {
+			t.Fatalf("v%d: WriteTo: %v", version, err)
+		}
+		out, err := readProxyHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("v%d: read: %v", version, err)
+		}
+		if !sameAddr(out.SourceAddr, in.SourceAddr) || !sameAddr(out.DestAddr, in.DestAddr) {
+			t.Fatalf("v%d: got %v -> %v", version, out.SourceAddr, out.DestAddr)
+		}
+		if user, _ := out.TLV(ProxyTLVUsername); version == 2 && string(user) != "user" {
+			t.Fatalf("v2: username TLV = %q", user)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"codeberg.org/peterzam/socks5/bandwidth"
+)
+
+// serverConfig is a validated copy of a Config with its defaults
+// applied. Sessions keep the serverConfig that was current when they
+// started, so a Reload only affects new sessions.
+type serverConfig struct {
+	Config
+	authMethods map[uint8]Authenticator
+	logger      StructuredLogger
+}
+
+// configContextKey carries the *serverConfig of a session
+var configContextKey = &contextKey{"config"}
+
+func (s *Server) currentConfig() *serverConfig {
+	return s.config.Load().(*serverConfig)
+}
+
+func (s *Server) storeConfig(sc *serverConfig) {
+	s.config.Store(sc)
+}
+
+// configFor returns the config of the session ctx belongs to, or the
+// current one outside of a session
+func (s *Server) configFor(ctx context.Context) *serverConfig {
+	if sc, ok := ctx.Value(configContextKey).(*serverConfig); ok {
+		return sc
+	}
+	return s.currentConfig()
+}
+
+// validate reports the first invalid setting of the Config
+func (c *Config) validate() error {
+	for i, a := range c.AuthMethods {
+		if a == nil {
+			return fmt.Errorf("auth method %d is nil", i)
+		}
+	}
+
+	b := c.Bandwidth
+	set := 0
+	for _, rate := range []*bandwidth.BandwidthConfig{b.ReadServerRate, b.WriteServerRate, b.ReadConnRate, b.WriteConnRate} {
+		if rate != nil {
+			set++
+		}
+	}
+	if set != 0 && set != 4 {
+		return fmt.Errorf("bandwidth config needs all of its server and connection rates, or none")
+	}
+
+	for name, v := range map[string]int{
+		"MaxConns":               c.MaxConns,
+		"MaxConnsPerIP":          c.MaxConnsPerIP,
+		"MaxConnsPerUser":        c.MaxConnsPerUser,
+		"MaxAssociationsPerUser": c.MaxAssociationsPerUser,
+		"UDPMaxReassemblyBytes":  c.UDPMaxReassemblyBytes,
+		"UDPFragmentSize":        c.UDPFragmentSize,
+		"MaxUDPMappings":         c.MaxUDPMappings,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative: %d", name, v)
+		}
+	}
+	for name, d := range map[string]int64{
+		"HandshakeTimeout":      int64(c.HandshakeTimeout),
+		"AuthTimeout":           int64(c.AuthTimeout),
+		"RequestTimeout":        int64(c.RequestTimeout),
+		"DialTimeout":           int64(c.DialTimeout),
+		"BindTimeout":           int64(c.BindTimeout),
+		"IdleTimeout":           int64(c.IdleTimeout),
+		"MaxSessionDuration":    int64(c.MaxSessionDuration),
+		"UDPReassemblyTimeout":  int64(c.UDPReassemblyTimeout),
+		"UDPMappingIdleTimeout": int64(c.UDPMappingIdleTimeout),
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// newServerConfig validates conf and returns a copy with defaults
+// applied. It does not modify conf nor s.
+func (s *Server) newServerConfig(conf *Config) (*serverConfig, error) {
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	sc := &serverConfig{Config: *conf}
+
+	// Ensure we have at least one authentication method enabled
+	if len(sc.AuthMethods) == 0 {
+		if sc.Credentials != nil {
+			sc.AuthMethods = []Authenticator{&UserPassAuthenticator{sc.Credentials}}
+		} else {
+			sc.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
+		}
+	} else {
+		sc.AuthMethods = append([]Authenticator(nil), sc.AuthMethods...)
+	}
+	sc.authMethods = authMethodsByCode(sc.AuthMethods)
+
+	// Ensure we have a DNS resolver
+	if sc.Resolver == nil {
+		sc.Resolver = DNSResolver{}
+	}
+
+	// Ensure we have a rule set
+	if sc.Rules == nil {
+		sc.Rules = PermitAll()
+	}
+
+	// Ensure we have a bandwidth limit of infinity
+	if sc.Bandwidth.ReadServerRate == nil {
+		sc.Bandwidth = *bandwidth.NeweSimpleListenerConfig(0, 0)
+	}
+
+	// Ensure we have a log target
+	if sc.Logger == nil {
+		sc.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+	sc.logger = sc.StructuredLogger
+	if sc.logger == nil {
+		sc.logger = NewPrintfLogger(sc.Logger)
+	}
+
+	if sc.HandleConnect == nil {
+		sc.HandleConnect = s.doHandleConnect
+	}
+
+	return sc, nil
+}
+
+// applyBandwidth copies the rates of sc into the limiter configs shared
+// by the listeners, so that running limiters pick them up, and points
+// sc at them. The first call creates the server-wide limiters. s.reloadMu
+// must be held.
+func (s *Server) applyBandwidth(sc *serverConfig) {
+	b := &s.bandwidth
+	if b.ReadServerRate == nil {
+		*b = *bandwidth.NeweSimpleListenerConfig(0, 0)
+		s.readLimiter = bandwidth.NewBandwidthLimiter(b.ReadServerRate)
+		s.writeLimiter = bandwidth.NewBandwidthLimiter(b.WriteServerRate)
+	}
+	copyRate(b.ReadServerRate, sc.Bandwidth.ReadServerRate)
+	copyRate(b.WriteServerRate, sc.Bandwidth.WriteServerRate)
+	copyRate(b.ReadConnRate, sc.Bandwidth.ReadConnRate)
+	copyRate(b.WriteConnRate, sc.Bandwidth.WriteConnRate)
+	sc.Bandwidth = *b
+}
+
+func copyRate(dst, src *bandwidth.BandwidthConfig) {
+	dst.SetLimit(src.GetLimit())
+	dst.SetBurst(src.GetBurst())
+}
+
+func authMethodsByCode(methods []Authenticator) map[uint8]Authenticator {
+	byCode := make(map[uint8]Authenticator)
+	for _, a := range methods {
+		byCode[a.GetCode()] = a
+	}
+	return byCode
+}
+
+// Reload validates conf and atomically makes it the configuration of
+// the Server. Sessions started afterwards use the new rules, auth
+// methods, resolver, rewriter, dialer, limits and timeouts, while
+// sessions already running keep the configuration they started with.
+// Bandwidth rates are the exception: they are shared limiters, so new
+// rates apply to running sessions of listeners without a Bandwidth
+// override as well.
+func (s *Server) Reload(conf *Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	sc, err := s.newServerConfig(conf)
+	if err != nil {
+		return err
+	}
+	s.applyBandwidth(sc)
+	s.storeConfig(sc)
+	return nil
+}
@@ -2,11 +2,14 @@ package socks5
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +34,10 @@ const (
 	// is used to establish an association within the UDP relay process to
 	// handle UDP datagrams.
 	CommandAssociate = uint8(3)
+	// CommandUDPOverTCP private CMD X'F5'. The UDP OVER TCP request is a
+	// UDP association whose datagrams are carried on the connection of
+	// the request, for clients behind networks blocking UDP.
+	CommandUDPOverTCP = uint8(0xf5)
 )
 
 // ATYP address type of following address declaration
@@ -108,7 +115,7 @@ func (a AddrSpec) Address() string {
 
 // A Request represents request received by a server
 type Request struct {
-	// Protocol version
+	// Protocol version, 5, 4 or 0 for HTTP proxy requests
 	Version uint8
 	// Requested command
 	Command uint8
@@ -121,6 +128,9 @@ type Request struct {
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
 	BufConn      io.Reader
+
+	// httpRequest is the first request of an HTTP forward proxy client
+	httpRequest *http.Request
 }
 
 // NewRequest creates a new Request from the tcp connection
@@ -153,27 +163,18 @@ func NewRequest(BufConn io.Reader) (*Request, error) {
 }
 
 // handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn net.Conn) error {
-	ctx := context.Background()
-
-	// Resolve the address if we have a FQDN
-	dest := req.DestAddr
-	if s.config.Resolver != nil && dest.FQDN != "" {
-		_ctx, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
-		if err != nil {
-			if err := sendReply(conn, ReplyHostUnreachable, nil); err != nil {
-				return fmt.Errorf("failed to send reply: %v", err)
-			}
-			return fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
-		}
-		ctx = _ctx
-		dest.IP = addr
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn net.Conn) error {
+	// HTTP forward proxy requests are resolved one by one
+	if req.httpRequest != nil {
+		return s.handleHTTPForward(ctx, conn, req)
 	}
 
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	ctx, err := s.resolveRequest(ctx, req)
+	if err != nil {
+		if err := sendSessionReply(ctx, conn, ReplyHostUnreachable, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return err
 	}
 
 	// Switch on the command
@@ -184,14 +185,51 @@ func (s *Server) handleRequest(req *Request, conn net.Conn) error {
 		return s.handleBind(ctx, conn, req)
 	case CommandAssociate:
 		return s.handleAssociate(ctx, conn, req)
+	case CommandUDPOverTCP:
+		return s.handleUDPOverTCP(ctx, conn, req)
 	default:
-		if err := sendReply(conn, ReplyCommandNotSupported, nil); err != nil {
+		if err := sendSessionReply(ctx, conn, ReplyCommandNotSupported, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return fmt.Errorf("unsupported command: %v", req.Command)
 	}
 }
 
+// resolveRequest resolves the destination of req if it is a FQDN and
+// applies any address rewrites
+func (s *Server) resolveRequest(ctx context.Context, req *Request) (context.Context, error) {
+	conf := s.configFor(ctx)
+
+	// Resolve the address if we have a FQDN
+	dest := req.DestAddr
+	if conf.Resolver != nil && dest.FQDN != "" {
+		_ctx, addr, err := s.resolve(ctx, dest.FQDN)
+		if err != nil {
+			s.logger(ctx).Debug("resolve failed", "fqdn", dest.FQDN, "error", err)
+			return ctx, fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+		}
+		ctx = _ctx
+		dest.IP = addr
+	}
+
+	// Apply any address rewrites
+	req.realDestAddr = req.DestAddr
+	if conf.Rewriter != nil {
+		ctx, req.realDestAddr = conf.Rewriter.Rewrite(ctx, req)
+	}
+	sessionFromContext(ctx).setRequest(req)
+	return ctx, nil
+}
+
+// resolve resolves fqdn with the configured NameResolver
+func (s *Server) resolve(ctx context.Context, fqdn string) (context.Context, net.IP, error) {
+	conf := s.configFor(ctx)
+	start := time.Now()
+	_ctx, addr, err := conf.Resolver.Resolve(ctx, fqdn)
+	conf.Metrics.resolved(time.Since(start), err)
+	return _ctx, addr, err
+}
+
 type conn interface {
 	Write([]byte) (int, error)
 	RemoteAddr() net.Addr
@@ -199,7 +237,7 @@ type conn interface {
 
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, nconn net.Conn, req *Request) error {
-	return s.config.HandleConnect(ctx, nconn, req, func(boundAddr net.Addr) error {
+	return s.configFor(ctx).HandleConnect(ctx, nconn, req, func(boundAddr net.Addr) error {
 		var bind *AddrSpec
 
 		if boundAddr != nil {
@@ -221,30 +259,61 @@ func (s *Server) handleConnect(ctx context.Context, nconn net.Conn, req *Request
 			}
 		}
 
-		if err := sendReply(nconn, ReplySucceeded, bind); err != nil {
+		if err := sendSessionReply(ctx, nconn, ReplySucceeded, bind); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
+		sessionFromContext(ctx).setPhase(PhaseRelaying)
 		return nil
 	}, func(err error) error {
-		msg := err.Error()
-		resp := ReplyHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = ReplyConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = ReplyNetworkUnreachable
-		}
-		if err := sendReply(nconn, resp, nil); err != nil {
+		if err := sendSessionReply(ctx, nconn, dialErrorReply(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return nil
 	})
 }
 
+// dialErrorReply maps a dial error to a reply code
+func dialErrorReply(err error) uint8 {
+	msg := err.Error()
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return ReplyTTLExpired
+	case strings.Contains(msg, "refused"):
+		return ReplyConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return ReplyNetworkUnreachable
+	}
+	return ReplyHostUnreachable
+}
+
+// dial connects to addr with the configured dialer, bounded by
+// DialTimeout
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conf := s.configFor(ctx)
+	dial := conf.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	if d := conf.DialTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	start := time.Now()
+	conn, err := dial(ctx, network, addr)
+	conf.Metrics.dialed(time.Since(start))
+	return conn, err
+}
+
 func (s *Server) doHandleConnect(ctx context.Context, nconn net.Conn, req *Request, replySuccess func(boundAddr net.Addr) error, replyError func(err error) error) error {
 	conn := conn(nconn)
+	conf := s.configFor(ctx)
+
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ReplyRuleFailure, nil); err != nil {
+	if ctx_, ok := conf.Rules.Allow(ctx, req); !ok {
+		if err := sendSessionReply(ctx, conn, ReplyRuleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
@@ -253,14 +322,11 @@ func (s *Server) doHandleConnect(ctx context.Context, nconn net.Conn, req *Reque
 	}
 
 	// Attempt to connect
-	dial := s.config.Dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
-		}
-	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	log := s.logger(ctx)
+	log.Debug("dialing", "real_dest", req.realDestAddr.String())
+	target, err := s.dial(ctx, "tcp", req.realDestAddr.Address())
 	if err != nil {
+		log.Debug("dial failed", "real_dest", req.realDestAddr.String(), "error", err)
 		errorOnReply := replyError(err)
 		if errorOnReply != nil {
 			return errorOnReply
@@ -269,6 +335,14 @@ func (s *Server) doHandleConnect(ctx context.Context, nconn net.Conn, req *Reque
 	}
 	defer target.Close()
 
+	// Announce the client to the target if a rule or rewriter asked to
+	if err := writeOutboundProxyHeader(ctx, target, req); err != nil {
+		if err := sendSessionReply(ctx, conn, ReplyServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("failed to write PROXY header to %v: %v", req.DestAddr, err)
+	}
+
 	// Send success
 	errOnReply := replySuccess(target.LocalAddr())
 	if errOnReply != nil {
@@ -276,14 +350,29 @@ func (s *Server) doHandleConnect(ctx context.Context, nconn net.Conn, req *Reque
 	}
 
 	// Start proxying
+	log.Debug("relaying", "real_dest", req.realDestAddr.String(), "local", target.LocalAddr().String())
+	return s.relay(ctx, nconn, req, target)
+}
+
+// relay shuffles data between the client and target until either side
+// is done or the relay is idle for IdleTimeout
+func (s *Server) relay(ctx context.Context, nconn net.Conn, req *Request, target net.Conn) error {
+	idle := newIdleTimer(s.configFor(ctx).IdleTimeout, func() {
+		target.Close()
+		nconn.Close()
+	})
+	defer idle.stop()
 	errCh := make(chan error, 2)
-	go proxy(target, req.BufConn, errCh)
-	go proxy(conn, target, errCh)
+	go proxy(target, idle.reader(req.BufConn), errCh)
+	go proxy(nconn, idle.reader(target), errCh)
 
 	// Wait
 	for i := 0; i < 2; i++ {
 		e := <-errCh
 		if e != nil {
+			if idle.expired() {
+				return ErrIdleTimeout
+			}
 			// return from this function closes target (and conn).
 			return e
 		}
@@ -291,65 +380,233 @@ func (s *Server) doHandleConnect(ctx context.Context, nconn net.Conn, req *Reque
 	return nil
 }
 
-// handleBind is used to handle a connect command
+// defaultBindTimeout bounds waiting for the inbound connection of a
+// BIND request when Config.BindTimeout is zero
+const defaultBindTimeout = 2 * time.Minute
+
+// ErrBindTimeout no connection came in for a BIND request in time
+var ErrBindTimeout = errors.New("timed out waiting for the BIND connection")
+
+// handleBind is used to handle a bind command. It listens on the egress
+// address, replies with it, and relays the first connection coming from
+// the destination of the request, announced in a second reply.
 func (s *Server) handleBind(ctx context.Context, conn net.Conn, req *Request) error {
+	conf := s.configFor(ctx)
+
 	// Check if this is allowed
-	_ctx, ok := s.config.Rules.Allow(ctx, req)
+	_ctx, ok := conf.Rules.Allow(ctx, req)
 	if !ok {
-		if err := sendReply(conn, ReplyRuleFailure, nil); err != nil {
+		if err := sendSessionReply(ctx, conn, ReplyRuleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return fmt.Errorf("bind to %v blocked by rules", req.DestAddr)
 	}
 	ctx = _ctx
+	log := s.logger(ctx)
 
-	// TODO: Support bind
-	if err := sendReply(conn, ReplyCommandNotSupported, nil); err != nil {
+	// Listen on the egress address
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", net.JoinHostPort(s.bindListenIP(ctx, conn, req.realDestAddr.IP).String(), "0"))
+	if err != nil {
+		if err := sendSessionReply(ctx, conn, ReplyServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("failed to listen for bind: %v", err)
+	}
+	defer ln.Close()
+
+	// The first reply tells where the destination should connect to
+	bound := ln.Addr().(*net.TCPAddr)
+	boundAddr := &AddrSpec{IP: s.advertiseIP(ctx, conn, bound.IP), Port: bound.Port}
+	if err := sendSessionReply(ctx, conn, ReplySucceeded, boundAddr); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
-	return nil
-}
+	log.Debug("waiting for bind connection", "bound", boundAddr.String())
 
-// handleAssociate is used to handle a connect command
-func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request) error {
-	// Check if this is allowed
-	_ctx, ok := s.config.Rules.Allow(ctx, req)
-	if !ok {
-		if err := sendReply(conn, ReplyRuleFailure, nil); err != nil {
+	target, err := s.acceptBind(ctx, ln, req)
+	if err != nil {
+		resp := ReplyServerFailure
+		if errors.Is(err, ErrBindTimeout) {
+			resp = ReplyTTLExpired
+		}
+		if err := sendSessionReply(ctx, conn, resp, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("associate to %v blocked by rules", req.DestAddr)
+		return err
 	}
-	ctx = _ctx
+	defer target.Close()
+	ln.Close()
 
-	// check bindIP 1st
-	if len(s.config.BindIP) == 0 || s.config.BindIP.IsUnspecified() {
-		s.config.BindIP = net.ParseIP("127.0.0.1")
+	// The second reply tells who connected
+	peer := target.RemoteAddr().(*net.TCPAddr)
+	if err := sendSessionReply(ctx, conn, ReplySucceeded, &AddrSpec{IP: peer.IP, Port: peer.Port}); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
 	}
+	sessionFromContext(ctx).setPhase(PhaseRelaying)
 
-	bindAddr := AddrSpec{IP: s.config.BindIP, Port: s.config.BindPort}
+	log.Debug("relaying", "real_dest", req.realDestAddr.String(), "peer", peer.String())
+	return s.relay(ctx, conn, req, target)
+}
 
-	if err := sendReply(conn, ReplySucceeded, &bindAddr); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+// egressIP returns the BindIP of the listener of the session of ctx,
+// else Config.BindIP, or nil when none is configured
+func (s *Server) egressIP(ctx context.Context) net.IP {
+	if ls := listenerFromContext(ctx); ls != nil && len(ls.bindIP) > 0 {
+		return ls.bindIP
+	}
+	return s.configFor(ctx).BindIP
+}
+
+// bindListenIP returns the egress address BIND listens on. When none
+// is configured, it is the unspecified address of the family of dest,
+// or else of the address the client connected to.
+func (s *Server) bindListenIP(ctx context.Context, conn net.Conn, dest net.IP) net.IP {
+	if ip := s.egressIP(ctx); len(ip) > 0 {
+		return ip
+	}
+	if len(dest) == 0 {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			dest = local.IP
+		}
+	}
+	if len(dest) > 0 && dest.To4() == nil {
+		return net.IPv6unspecified
 	}
+	return net.IPv4zero
+}
 
-	// wait here till the client close the connection
-	// check every 10 secs
-	tmp := []byte{}
-	var neverTimeout time.Time
+// advertiseIP returns the address sent in the replies of BIND and UDP
+// ASSOCIATE for a socket listening on ip: AdvertiseIP if set, else ip
+// unless unspecified, else the address the client connected to
+func (s *Server) advertiseIP(ctx context.Context, conn net.Conn, ip net.IP) net.IP {
+	if adv := s.configFor(ctx).AdvertiseIP; len(adv) > 0 {
+		return adv
+	}
+	if len(ip) > 0 && !ip.IsUnspecified() {
+		return ip
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && !local.IP.IsUnspecified() {
+		return local.IP
+	}
+	return net.ParseIP("127.0.0.1")
+}
+
+// acceptBind waits for a connection on ln from the destination IP of
+// req, bounded by BindTimeout. Connections from other IPs are refused,
+// an unspecified destination IP matches any. The port is not checked:
+// clients name the destination of their primary connection, as FTP
+// does, which connects back from another port.
+func (s *Server) acceptBind(ctx context.Context, ln net.Listener, req *Request) (net.Conn, error) {
+	timeout := s.configFor(ctx).BindTimeout
+	if timeout <= 0 {
+		timeout = defaultBindTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	want := req.realDestAddr
 	for {
-		conn.SetReadDeadline(time.Now())
-		if _, err := conn.Read(tmp); err == io.EOF {
-			break
-		} else {
-			conn.SetReadDeadline(neverTimeout)
+		conn, err := ln.Accept()
+		if err != nil {
+			switch ctx.Err() {
+			case context.DeadlineExceeded:
+				return nil, ErrBindTimeout
+			case nil:
+				return nil, fmt.Errorf("failed to accept bind connection: %v", err)
+			}
+			return nil, ctx.Err()
 		}
-		time.Sleep(10 * time.Second)
+		peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if ok && (len(want.IP) == 0 || want.IP.IsUnspecified() || want.IP.Equal(peer.IP)) {
+			return conn, nil
+		}
+		s.logger(ctx).Warn("refused bind connection", "peer", conn.RemoteAddr().String(), "real_dest", want.String())
+		conn.Close()
 	}
+}
+
+// handleAssociate is used to handle a connect command
+func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request) error {
+	ctx, release, err := s.admitAssociation(ctx, conn, req)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Every association gets its own relay socket
+	relay, err := s.listenUDPRelay(ctx, conn, req)
+	if err != nil {
+		// A relay nobody can send to is of no use to the client
+		resp := ReplyServerFailure
+		if err == errUDPClientUnknown {
+			resp = ReplyAddrTypeNotSupported
+		}
+		if err := sendSessionReply(ctx, conn, resp, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("failed to listen for udp: %v", err)
+	}
+	defer relay.conn.Close()
+
+	relayAddr := relay.conn.LocalAddr().(*net.UDPAddr)
+	bindAddr := AddrSpec{
+		IP:   s.advertiseIP(ctx, conn, relayAddr.IP),
+		Port: relayAddr.Port,
+	}
+	if err := sendSessionReply(ctx, conn, ReplySucceeded, &bindAddr); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	sessionFromContext(ctx).setPhase(PhaseRelaying)
+	go s.serveUDPRelay(ctx, relay)
+
+	// The association lasts until the client closes the connection, or
+	// the server closes it on shutdown. Hold it below the bandwidth
+	// limiter, which takes a buffer worth of budget before every read.
+	hold := conn
+	if lc, ok := findLimitedConn(conn).(interface{ NetConn() net.Conn }); ok {
+		hold = lc.NetConn()
+	}
+	io.Copy(io.Discard, hold)
 
 	return nil
 }
 
+// admitAssociation checks an association request against the rules and
+// the per user association limit, replying on failure. release ends the
+// association of the user.
+func (s *Server) admitAssociation(ctx context.Context, conn net.Conn, req *Request) (_ context.Context, release func(), err error) {
+	conf := s.configFor(ctx)
+
+	// Check if this is allowed
+	_ctx, ok := conf.Rules.Allow(ctx, req)
+	if !ok {
+		if err := sendSessionReply(ctx, conn, ReplyRuleFailure, nil); err != nil {
+			return nil, nil, fmt.Errorf("failed to send reply: %v", err)
+		}
+		return nil, nil, fmt.Errorf("associate to %v blocked by rules", req.DestAddr)
+	}
+	ctx = _ctx
+
+	// Enforce the per user association limit
+	release = func() {}
+	if user := authUsername(req.AuthContext); user != "" {
+		if !s.limits.acquireAssociation(user, conf.MaxAssociationsPerUser) {
+			err := sendSessionReply(ctx, conn, ReplyRuleFailure, nil)
+			s.logger(ctx).Warn("associate rejected", "error", ErrTooManyAssociationsPerUser)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to send reply: %v", err)
+			}
+			return nil, nil, ErrTooManyAssociationsPerUser
+		}
+		release = func() { s.limits.releaseAssociation(user) }
+	}
+	return ctx, release, nil
+}
+
 /***********************************
     Requests of client:
 
@@ -412,52 +669,101 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
-// sendReply is used to send a reply message
-func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
-	// Format the address
-	var addrType uint8
-	var addrBody []byte
-	var addrPort uint16
+// appendAddrSpec appends the ATYP, address and port of addr to b. A nil
+// addr is appended as the IPv4 address 0.0.0.0:0.
+func appendAddrSpec(b []byte, addr *AddrSpec) ([]byte, error) {
 	switch {
 	case addr == nil:
-		addrType = AddressIPv4
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
+		return append(b, AddressIPv4, 0, 0, 0, 0, 0, 0), nil
 
 	case addr.FQDN != "":
-		addrType = AddressDomainName
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
+		if len(addr.FQDN) > 255 {
+			return nil, fmt.Errorf("domain name too long: %s", addr.FQDN)
+		}
+		b = append(b, AddressDomainName, byte(len(addr.FQDN)))
+		b = append(b, addr.FQDN...)
 
 	case addr.IP.To4() != nil:
-		addrType = AddressIPv4
-		addrBody = []byte(addr.IP.To4())
-		addrPort = uint16(addr.Port)
+		b = append(b, AddressIPv4)
+		b = append(b, addr.IP.To4()...)
 
 	case addr.IP.To16() != nil:
-		addrType = AddressIPv6
-		addrBody = []byte(addr.IP.To16())
-		addrPort = uint16(addr.Port)
+		b = append(b, AddressIPv6)
+		b = append(b, addr.IP.To16()...)
 
 	default:
-		return fmt.Errorf("failed to format address: %v", addr)
+		return nil, fmt.Errorf("failed to format address: %v", addr)
 	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port&0xff)), nil
+}
 
+// sendReply is used to send a reply message
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	msg, err := appendAddrSpec([]byte{socks5Version, resp, 0}, addr)
+	if err != nil {
+		return err
+	}
 
 	// Send the message
-	_, err := w.Write(msg)
+	_, err = w.Write(msg)
 	return err
 }
 
+// ErrIdleTimeout a relay was closed after IdleTimeout without traffic
+var ErrIdleTimeout = errors.New("relay idle timeout")
+
+// idleTimer fires onIdle once none of its readers saw traffic for the
+// timeout. A nil idleTimer (no timeout configured) never fires.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32 // accessed atomically
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&t.fired, 1)
+		onIdle()
+	})
+	return t
+}
+
+// reader wraps r so that every successful read resets the timer
+func (t *idleTimer) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &idleReader{Reader: r, timer: t}
+}
+
+func (t *idleTimer) expired() bool {
+	return t != nil && atomic.LoadInt32(&t.fired) != 0
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+type idleReader struct {
+	io.Reader
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.timer.timer.Reset(r.timer.timeout)
+	}
+	return n, err
+}
+
 type closeWriter interface {
 	CloseWrite() error
 }
@@ -34,7 +34,7 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 		return ctx, p.EnableConnect
 	case CommandBind:
 		return ctx, p.EnableBind
-	case CommandAssociate:
+	case CommandAssociate, CommandUDPOverTCP:
 		return ctx, p.EnableAssociate
 	}
 
@@ -0,0 +1,393 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// contextKey is a value for use with context.WithValue. It's used as
+// a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "socks5 context value " + k.name }
+
+var (
+	// sessionContextKey carries the *session being served
+	sessionContextKey = &contextKey{"session"}
+	// clientAddrContextKey carries the client address (net.Addr)
+	clientAddrContextKey = &contextKey{"client-addr"}
+	// authContextContextKey carries the negotiated *AuthContext
+	authContextContextKey = &contextKey{"auth-context"}
+	// replyFuncContextKey carries the replyFunc of the protocol version
+	// spoken by the client, sendReply when unset
+	replyFuncContextKey = &contextKey{"reply-func"}
+)
+
+// SessionIDFromContext returns the ID of the session ctx belongs to,
+// or "" if ctx was not created by the Server.
+func SessionIDFromContext(ctx context.Context) string {
+	if sess := sessionFromContext(ctx); sess != nil {
+		return sess.id
+	}
+	return ""
+}
+
+// ClientAddrFromContext returns the remote address of the client
+// connection ctx belongs to, or nil.
+func ClientAddrFromContext(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(clientAddrContextKey).(net.Addr)
+	return addr
+}
+
+// AuthContextFromContext returns the AuthContext negotiated for the
+// session ctx belongs to, or nil if authentication has not completed.
+func AuthContextFromContext(ctx context.Context) *AuthContext {
+	authContext, _ := ctx.Value(authContextContextKey).(*AuthContext)
+	return authContext
+}
+
+func sessionFromContext(ctx context.Context) *session {
+	sess, _ := ctx.Value(sessionContextKey).(*session)
+	return sess
+}
+
+// SessionPhase is the stage a session has reached
+type SessionPhase int
+
+const (
+	// PhaseHandshake the client is sending its greeting
+	PhaseHandshake SessionPhase = iota
+	// PhaseAuth the selected Authenticator is running
+	PhaseAuth
+	// PhaseDialing the request is being resolved, checked and dialed
+	PhaseDialing
+	// PhaseRelaying the success reply was sent and traffic is flowing
+	PhaseRelaying
+)
+
+func (p SessionPhase) String() string {
+	switch p {
+	case PhaseHandshake:
+		return "handshake"
+	case PhaseAuth:
+		return "auth"
+	case PhaseDialing:
+		return "dialing"
+	case PhaseRelaying:
+		return "relaying"
+	}
+	return "unknown"
+}
+
+// SessionInfo is a point in time snapshot of a session
+type SessionInfo struct {
+	// ID uniquely identifies the session
+	ID string
+	// RemoteAddr of the client connection
+	RemoteAddr net.Addr
+	// Username from the AuthContext, empty if none was negotiated
+	Username string
+	// Command requested, zero before the request was read
+	Command uint8
+	// DestAddr as requested by the client
+	DestAddr *AddrSpec
+	// RealDestAddr after resolution and rewriting
+	RealDestAddr *AddrSpec
+	// StartTime is when the connection was accepted
+	StartTime time.Time
+	// BytesUp counts bytes read from the client
+	BytesUp int64
+	// BytesDown counts bytes written to the client
+	BytesDown int64
+	// Phase the session is in
+	Phase SessionPhase
+}
+
+// session tracks a single connection served by ServeConnContext
+type session struct {
+	// accessed atomically, kept first for 64-bit alignment
+	bytesUp   int64
+	bytesDown int64
+
+	id     string
+	cancel context.CancelFunc
+	start  time.Time
+	// lifetime is the deadline MaxSessionDuration sets on the session
+	// context, zero without one
+	lifetime time.Time
+
+	mu           sync.Mutex
+	remoteAddr   net.Addr
+	phase        SessionPhase
+	username     string
+	command      uint8
+	destAddr     *AddrSpec
+	realDestAddr *AddrSpec
+	replied      bool
+	reply        uint8
+	killReason   string
+}
+
+func newSession(conn net.Conn, cancel context.CancelFunc) *session {
+	// The client address of a PROXY header is not known until it is read
+	remoteAddr := conn.RemoteAddr
+	if pc := proxyProtocolConnOf(conn); pc != nil {
+		remoteAddr = pc.Conn.RemoteAddr
+	}
+	return &session{
+		id:         newSessionID(),
+		cancel:     cancel,
+		start:      time.Now(),
+		remoteAddr: remoteAddr(),
+		phase:      PhaseHandshake,
+	}
+}
+
+// newSessionID returns a random identifier for a session
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// The setters below are no-ops on a nil session, so handlers may be
+// driven without ServeConnContext (e.g. from a custom HandleConnect).
+
+func (sess *session) setRemoteAddr(addr net.Addr) {
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	sess.remoteAddr = addr
+	sess.mu.Unlock()
+}
+
+func (sess *session) setPhase(phase SessionPhase) {
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	sess.phase = phase
+	sess.mu.Unlock()
+}
+
+func (sess *session) setAuthContext(authContext *AuthContext) {
+	if sess == nil || authContext == nil {
+		return
+	}
+	sess.mu.Lock()
+	sess.username = authUsername(authContext)
+	sess.mu.Unlock()
+}
+
+func (sess *session) setRequest(req *Request) {
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	sess.command = req.Command
+	sess.destAddr = req.DestAddr
+	sess.realDestAddr = req.realDestAddr
+	sess.mu.Unlock()
+}
+
+func (sess *session) setReply(resp uint8) {
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	sess.replied = true
+	sess.reply = resp
+	sess.mu.Unlock()
+}
+
+// logFields returns the key/value pairs identifying the session in logs
+func (sess *session) logFields() []interface{} {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	fields := []interface{}{
+		"session", sess.id,
+		"client", sess.remoteAddr.String(),
+		"user", sess.username,
+	}
+	if sess.command != 0 {
+		fields = append(fields, "command", commandName(sess.command))
+	}
+	if sess.destAddr != nil {
+		fields = append(fields, "dest", sess.destAddr.String())
+	}
+	if sess.replied {
+		fields = append(fields, "reply", sess.reply)
+	}
+	return fields
+}
+
+// recordReply accounts a reply sent to the client of the session of ctx
+func recordReply(ctx context.Context, resp uint8) {
+	sessionFromContext(ctx).setReply(resp)
+	metricsFromContext(ctx).reply(resp)
+}
+
+// replyFunc writes a reply given as a SOCKS5 reply code
+type replyFunc func(w io.Writer, resp uint8, addr *AddrSpec) error
+
+// sendSessionReply sends a reply in the protocol version of the session
+// of ctx and records its code on the session
+func sendSessionReply(ctx context.Context, w io.Writer, resp uint8, addr *AddrSpec) error {
+	recordReply(ctx, resp)
+	if reply, ok := ctx.Value(replyFuncContextKey).(replyFunc); ok {
+		return reply(w, resp, addr)
+	}
+	return sendReply(w, resp, addr)
+}
+
+// kill cancels the session, recording why it was ended
+func (sess *session) kill(reason string) {
+	sess.mu.Lock()
+	if sess.killReason == "" {
+		sess.killReason = reason
+	}
+	sess.mu.Unlock()
+	sess.cancel()
+}
+
+func (sess *session) addBytesUp(n int) {
+	if sess != nil {
+		atomic.AddInt64(&sess.bytesUp, int64(n))
+	}
+}
+
+func (sess *session) addBytesDown(n int) {
+	if sess != nil {
+		atomic.AddInt64(&sess.bytesDown, int64(n))
+	}
+}
+
+// bytes returns the traffic of the session so far
+func (sess *session) bytes() (up, down int64) {
+	if sess == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&sess.bytesUp), atomic.LoadInt64(&sess.bytesDown)
+}
+
+func (sess *session) info() SessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return SessionInfo{
+		ID:           sess.id,
+		RemoteAddr:   sess.remoteAddr,
+		Username:     sess.username,
+		Command:      sess.command,
+		DestAddr:     sess.destAddr,
+		RealDestAddr: sess.realDestAddr,
+		StartTime:    sess.start,
+		BytesUp:      atomic.LoadInt64(&sess.bytesUp),
+		BytesDown:    atomic.LoadInt64(&sess.bytesDown),
+		Phase:        sess.phase,
+	}
+}
+
+// countingConn accounts the traffic of a client connection to its session
+type countingConn struct {
+	net.Conn
+	sess    *session
+	metrics *Metrics
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.sess.addBytesUp(n)
+	c.metrics.addBytesUp(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sess.addBytesDown(n)
+	c.metrics.addBytesDown(n)
+	return n, err
+}
+
+// NetConn returns the counted connection
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// findConn returns the first of conn and the connections it wraps, as
+// told by their NetConn method, for which match returns true, or nil
+func findConn(conn net.Conn, match func(net.Conn) bool) net.Conn {
+	for conn != nil {
+		if match(conn) {
+			return conn
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = nc.NetConn()
+	}
+	return nil
+}
+
+// trackedSessions returns the sessions currently registered
+func (s *Server) trackedSessions() []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*session, 0, len(s.activeConn))
+	for sess := range s.activeConn {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// Sessions returns a snapshot of every session currently served,
+// oldest first.
+func (s *Server) Sessions() []SessionInfo {
+	sessions := s.trackedSessions()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, sess.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	return infos
+}
+
+// KillSession ends the session with the given ID, closing its client
+// connection and anything it relays to. It reports whether the session
+// was found.
+func (s *Server) KillSession(id string) bool {
+	for _, sess := range s.trackedSessions() {
+		if sess.id == id {
+			sess.kill(endReasonKilled)
+			return true
+		}
+	}
+	return false
+}
+
+// KillSessions ends every session for which filter returns true and
+// returns how many were ended.
+func (s *Server) KillSessions(filter func(SessionInfo) bool) int {
+	killed := 0
+	for _, sess := range s.trackedSessions() {
+		if filter(sess.info()) {
+			sess.kill(endReasonKilled)
+			killed++
+		}
+	}
+	return killed
+}
@@ -0,0 +1,151 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+/*********************************************************
+    SOCKS4 request, after the version byte:
+
+    +----+----+----+----+----+----+----+----+----+----+....+----+
+    | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+    +----+----+----+----+----+----+----+----+----+----+....+----+
+      1    1      2              4           variable       1
+
+    SOCKS4a sets DSTIP to 0.0.0.x (x != 0) and appends the domain
+    name, NULL terminated, after the USERID.
+
+    Reply:
+
+    +----+----+----+----+----+----+----+----+
+    | VN | CD | DSTPORT |      DSTIP        |
+    +----+----+----+----+----+----+----+----+
+      1    1      2              4
+**********************************************************/
+
+const socks4Version = uint8(4)
+
+// SOCKS4 reply codes
+const (
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+)
+
+// socks4MaxField bounds the USERID and domain name fields
+const socks4MaxField = 255
+
+// errSOCKS4NoAuth SOCKS4 clients can't authenticate
+var errSOCKS4NoAuth = errors.New("SOCKS4 needs the no authentication method enabled")
+
+// readSOCKS4Request reads a SOCKS4 or SOCKS4a request, once the version
+// byte was read, into a Request handled like a SOCKS5 one. The USERID
+// is stored as Payload["UserID"] of a "No Authentication" AuthContext.
+// The returned context makes the session reply in SOCKS4.
+func (s *Server) readSOCKS4Request(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) (context.Context, *Request, error) {
+	log := s.logger(ctx)
+	ctx = context.WithValue(ctx, replyFuncContextKey, replyFunc(sendSOCKS4Reply))
+
+	setConnDeadline(conn, s.configFor(ctx).RequestTimeout)
+	header := []byte{0, 0, 0, 0, 0, 0, 0}
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		log.Warn("failed to read request", "error", err)
+		return ctx, nil, fmt.Errorf("failed to get SOCKS4 request: %v", err)
+	}
+	userID, err := readNulString(bufConn)
+	if err != nil {
+		log.Warn("failed to read request", "error", err)
+		return ctx, nil, fmt.Errorf("failed to get SOCKS4 user id: %v", err)
+	}
+	dest := &AddrSpec{
+		IP:   net.IPv4(header[3], header[4], header[5], header[6]),
+		Port: int(header[1])<<8 | int(header[2]),
+	}
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		// SOCKS4a
+		fqdn, err := readNulString(bufConn)
+		if err != nil {
+			log.Warn("failed to read request", "error", err)
+			return ctx, nil, fmt.Errorf("failed to get SOCKS4a domain name: %v", err)
+		}
+		dest.IP, dest.FQDN = nil, fqdn
+	}
+
+	authContext := &AuthContext{AuthMethodNoAuth, map[string]string{"UserID": userID}}
+	ctx = context.WithValue(ctx, authContextContextKey, authContext)
+	sessionFromContext(ctx).setAuthContext(authContext)
+	if !s.socks4Allowed(ctx) {
+		if err := sendSessionReply(ctx, conn, ReplyRuleFailure, nil); err != nil {
+			return ctx, nil, fmt.Errorf("failed to send reply: %v", err)
+		}
+		log.Warn("authentication failed", "error", errSOCKS4NoAuth)
+		return ctx, nil, errSOCKS4NoAuth
+	}
+
+	// SOCKS4 has no UDP ASSOCIATE
+	if header[0] != CommandConnect && header[0] != CommandBind {
+		if err := sendSessionReply(ctx, conn, ReplyCommandNotSupported, nil); err != nil {
+			return ctx, nil, fmt.Errorf("failed to send reply: %v", err)
+		}
+		return ctx, nil, fmt.Errorf("unsupported SOCKS4 command: %v", header[0])
+	}
+
+	return ctx, &Request{
+		Version:     socks4Version,
+		Command:     header[0],
+		AuthContext: authContext,
+		DestAddr:    dest,
+		BufConn:     bufConn,
+	}, nil
+}
+
+// socks4Allowed reports whether "auth-less" mode is enabled for the
+// session of ctx
+func (s *Server) socks4Allowed(ctx context.Context) bool {
+	switch s.sessionAuthMethods(ctx)[AuthMethodNoAuth].(type) {
+	case NoAuthAuthenticator, *NoAuthAuthenticator:
+		return true
+	}
+	return false
+}
+
+// readNulString reads a NULL terminated field of at most socks4MaxField
+// bytes
+func readNulString(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == socks4MaxField {
+			return "", fmt.Errorf("field longer than %d bytes", socks4MaxField)
+		}
+		b = append(b, c)
+	}
+}
+
+// sendSOCKS4Reply is the SOCKS4 replyFunc. Any failure is reported as
+// rejected, and addresses other than IPv4 as 0.0.0.0.
+func sendSOCKS4Reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[1] = socks4Rejected
+	if resp == ReplySucceeded {
+		msg[1] = socks4Granted
+	}
+	if addr != nil {
+		msg[2], msg[3] = byte(addr.Port>>8), byte(addr.Port)
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(msg[4:], ip4)
+		}
+	}
+	_, err := w.Write(msg)
+	return err
+}
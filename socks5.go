@@ -3,10 +3,12 @@ package socks5
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"codeberg.org/peterzam/socks5/bandwidth"
 )
@@ -15,6 +17,10 @@ const (
 	socks5Version = uint8(5)
 )
 
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe
+// methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("socks: Server closed")
+
 // ErrorLogger error handler, compatible with std logger
 type ErrorLogger interface {
 	Printf(format string, v ...interface{})
@@ -45,16 +51,73 @@ type Config struct {
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
-	// BindIP is used for bind or udp associate
+	// BindIP is the egress address BIND listens on and UDP datagrams
+	// are sent from
 	BindIP net.IP
 
-	// BindIP is used for bind or udp associate
+	// UDPRelayIP is the address the UDP relays of associations listen
+	// on. Defaults to the address the client connected to.
+	UDPRelayIP net.IP
+
+	// Deprecated: every UDP association gets its own relay socket,
+	// BindPort is ignored.
 	BindPort int
 
+	// UDPReassemblyTimeout is the reassembly timer of fragmented UDP
+	// datagrams, started by the first fragment. Zero means 5 seconds.
+	UDPReassemblyTimeout time.Duration
+
+	// UDPMaxReassemblyBytes caps the data queued for reassembly per UDP
+	// association. Zero means 64 KiB.
+	UDPMaxReassemblyBytes int
+
+	// UDPFragmentSize is the data size of the fragments of datagrams
+	// sent to clients which sent fragments themselves. Zero means 1200.
+	UDPFragmentSize int
+
+	// UDPFilter selects which datagrams coming back to the NAT mapping
+	// of a UDP destination are relayed to the client. Defaults to those
+	// from the address of the destination.
+	UDPFilter UDPFilter
+
+	// UDPMappingIdleTimeout expires the NAT mapping of a UDP destination
+	// once the client sent it nothing for that long. Zero means 2
+	// minutes.
+	UDPMappingIdleTimeout time.Duration
+
+	// MaxUDPMappings caps the NAT mappings, so the destinations, of a
+	// UDP association. Datagrams to further destinations are dropped
+	// until a mapping expires. Zero means 256.
+	MaxUDPMappings int
+
+	// UDPBandwidthPolicing drops the UDP datagrams exceeding the
+	// bandwidth limits, which UDP associations share with their control
+	// connection, instead of delaying them
+	UDPBandwidthPolicing bool
+
+	// AdvertiseIP is the address sent in the replies of BIND and UDP
+	// ASSOCIATE, such as the public address of a server behind NAT.
+	// Defaults to the listening address, or the address the client
+	// connected to.
+	AdvertiseIP net.IP
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger ErrorLogger
 
+	// StructuredLogger takes precedence over Logger when provided. Every
+	// line logged for a session carries its session, client, user,
+	// command, dest and reply fields. A *slog.Logger can be used as is.
+	StructuredLogger StructuredLogger
+
+	// Metrics collects counters of the sessions, see NewMetrics.
+	// Optional.
+	Metrics *Metrics
+
+	// AccessLog receives one record per finished session, see
+	// NewJSONAccessLogger and NewTemplateAccessLogger. Optional.
+	AccessLog AccessLogger
+
 	// Bandwidth Rate limiter
 	Bandwidth bandwidth.ListenerConfig
 
@@ -63,60 +126,107 @@ type Config struct {
 
 	// HandleConnect is an optional function for handling SOCKS connect requests
 	HandleConnect func(ctx context.Context, conn net.Conn, req *Request, replySuccess func(boundAddr net.Addr) error, replyError func(err error) error) error
+
+	// EnableSOCKS4 serves SOCKS4 and SOCKS4a clients as well. As they
+	// can't authenticate, they are only accepted when "auth-less" mode
+	// is enabled, and their USERID is only informative.
+	EnableSOCKS4 bool
+
+	// EnableHTTPProxy serves HTTP proxy clients on the same port,
+	// told apart from SOCKS by their first byte. CONNECT tunnels go
+	// through the same rules, rewriter, resolver and dialer as a SOCKS
+	// CONNECT, and so does every absolute-URI request (GET http://...)
+	// of forward proxy clients. Clients authenticate with Basic
+	// Proxy-Authorization.
+	EnableHTTPProxy bool
+
+	// HTTPProxyVia is added as pseudonym of a Via header to the requests
+	// and responses of HTTP forward proxy clients. Empty adds none.
+	HTTPProxyVia string
+
+	// HTTPProxyXForwardedFor appends the client IP to the
+	// X-Forwarded-For header of requests of HTTP forward proxy clients
+	HTTPProxyXForwardedFor bool
+
+	// MaxConns caps the number of concurrent sessions.
+	// Zero means no limit.
+	MaxConns int
+
+	// MaxConnsPerIP caps the concurrent sessions of a single client IP.
+	// It is checked before the handshake. Zero means no limit.
+	MaxConnsPerIP int
+
+	// MaxConnsPerUser caps the concurrent sessions of an authenticated
+	// username. It is checked after authentication. Zero means no limit.
+	MaxConnsPerUser int
+
+	// MaxAssociationsPerUser caps the concurrent UDP associations of an
+	// authenticated username. Zero means no limit.
+	MaxAssociationsPerUser int
+
+	// HandshakeTimeout bounds reading the version byte and the auth
+	// methods of the client greeting. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// AuthTimeout bounds the authentication subnegotiation.
+	// Zero means no timeout.
+	AuthTimeout time.Duration
+
+	// RequestTimeout bounds reading the request after authentication.
+	// Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// DialTimeout bounds dialing the destination. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// BindTimeout bounds waiting for the inbound connection of a BIND
+	// request. Zero means two minutes.
+	BindTimeout time.Duration
+
+	// IdleTimeout closes a relayed connection once no traffic was seen
+	// in either direction for that long. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// MaxSessionDuration closes a session that lasts longer, whatever
+	// its activity. Zero means no limit.
+	MaxSessionDuration time.Duration
 }
 
 // Server is responsible for accepting connections and handling
 // the details of the SOCKS5 protocol
 type Server struct {
-	config      *Config
-	authMethods map[uint8]Authenticator
-}
-
-// New creates a new Server and potentially returns an error
-func New(conf *Config) (*Server, error) {
-	// Ensure we have at least one authentication method enabled
-	if len(conf.AuthMethods) == 0 {
-		if conf.Credentials != nil {
-			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
-		} else {
-			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
-		}
-	}
-
-	// Ensure we have a DNS resolver
-	if conf.Resolver == nil {
-		conf.Resolver = DNSResolver{}
-	}
-
-	// Ensure we have a rule set
-	if conf.Rules == nil {
-		conf.Rules = PermitAll()
-	}
+	config atomic.Value // *serverConfig
 
-	// Ensure we have a bandwidth limit of infinity
-	if conf.Bandwidth.ReadServerRate == nil {
-		conf.Bandwidth = *bandwidth.NeweSimpleListenerConfig(0, 0)
-	}
+	// reloadMu serializes Reload, bandwidth holds the limiter configs
+	// shared by every listener without an override, updated in place
+	reloadMu  sync.Mutex
+	bandwidth bandwidth.ListenerConfig
 
-	// Ensure we have a log target
-	if conf.Logger == nil {
-		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
-	}
+	// readLimiter and writeLimiter enforce the server-wide rates of
+	// bandwidth across all the listeners sharing it
+	readLimiter  bandwidth.BandwidthLimiter
+	writeLimiter bandwidth.BandwidthLimiter
 
-	server := &Server{
-		config: conf,
-	}
+	inShutdown int32 // accessed atomically (non-zero means we're shutting down)
 
-	if conf.HandleConnect == nil {
-		conf.HandleConnect = server.doHandleConnect
-	}
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	activeConn map[*session]struct{}
 
-	server.authMethods = make(map[uint8]Authenticator)
+	limits connLimits
+}
 
-	for _, a := range conf.AuthMethods {
-		server.authMethods[a.GetCode()] = a
+// New creates a new Server and potentially returns an error.
+// The Config is copied, changing it afterwards has no effect on the
+// Server; use Reload instead.
+func New(conf *Config) (*Server, error) {
+	server := &Server{}
+	sc, err := server.newServerConfig(conf)
+	if err != nil {
+		return nil, err
 	}
-
+	server.applyBandwidth(sc)
+	server.storeConfig(sc)
 	return server, nil
 }
 
@@ -129,85 +239,416 @@ func (s *Server) ListenAndServe(network, addr string) error {
 	return s.Serve(l)
 }
 
-// Serve is used to serve connections from a listener
+// Serve is used to serve connections from a listener.
+// Serve always returns a non-nil error. After Shutdown or Close, the
+// returned error is ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
-	// open a UDP server if specified in config
-	if s.config.BindPort > 0 {
-		ip, _, _ := net.SplitHostPort(l.Addr().String())
-		addr := net.UDPAddr{
-			Port: s.config.BindPort,
-			IP:   net.ParseIP(ip),
+	return s.ServeContext(context.Background(), l)
+}
+
+// ServeContext is like Serve, but every session context is derived from
+// ctx. Cancelling ctx closes l, cancels all sessions started from it and
+// makes ServeContext return ctx.Err().
+func (s *Server) ServeContext(ctx context.Context, l net.Listener) error {
+	return s.serveListener(ctx, &Listener{Listener: l}, nil)
+}
+
+// serveListener accepts sessions from ln until it fails, ctx is
+// cancelled or stop is closed.
+func (s *Server) serveListener(ctx context.Context, ln *Listener, stop <-chan struct{}) error {
+	l := ln.Listener
+	done := make(chan struct{})
+	defer close(done)
+	go func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		case <-done:
+			return
 		}
+		l.Close()
+	}(ctx)
+
+	origListener := l
+	if !s.trackListener(&origListener, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(&origListener, false)
+
+	ls := newListenerState(ln)
+	ctx = context.WithValue(ctx, listenerContextKey, ls)
+
+	// Listeners with their own rates get their own server limiters
+	if ln.Bandwidth != nil {
+		l = bandwidth.NewListener(ctx, ln.Bandwidth, l)
+	} else {
+		l = bandwidth.NewSharedListener(ctx, &s.bandwidth, s.readLimiter, s.writeLimiter, l)
+	}
 
-		c, err := net.ListenUDP("udp", &addr)
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				s.logger(ctx).Warn("accept failed, retrying", "error", err, "delay", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
 			return err
 		}
-		go s.handleUDP(c)
+		tempDelay = 0
+		go s.ServeConnContext(ctx, conn)
 	}
+}
 
-	ctx := context.Background()
-	l = bandwidth.NewListener(ctx, &s.config.Bandwidth, l)
+// shutdownPollIntervalMax is the max polling interval when checking
+// quiescence during Server.Shutdown.
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active sessions. Shutdown works by first closing all open listeners
+// and UDP relays, then letting connections still in the handshake finish
+// it (their request is refused with ReplyServerFailure), and then waiting
+// for active CONNECT relays and UDP associations to end on their own.
+// If the provided context expires before that, the remaining connections
+// are closed and the context's error is returned.
+//
+// Once Shutdown has been called on a server, it may not be reused;
+// future calls to methods such as Serve will return ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	pollIntervalBase := time.Millisecond
+	nextPollInterval := func() time.Duration {
+		// Add 10% jitter.
+		interval := pollIntervalBase + time.Duration(time.Now().UnixNano()%int64(pollIntervalBase/10+1))
+		// Double and clamp for next time.
+		pollIntervalBase *= 2
+		if pollIntervalBase > shutdownPollIntervalMax {
+			pollIntervalBase = shutdownPollIntervalMax
+		}
+		return interval
+	}
 
+	timer := time.NewTimer(nextPollInterval())
+	defer timer.Stop()
 	for {
-		conn, err := l.Accept()
-		if err != nil {
+		if s.numActiveConns() == 0 {
 			return err
 		}
-		go s.ServeConn(conn)
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-timer.C:
+			timer.Reset(nextPollInterval())
+		}
 	}
 }
 
-// ServeConn is used to serve a single connection.
-func (s *Server) ServeConn(conn net.Conn) error {
-	defer conn.Close()
-	bufConn := bufio.NewReader(conn)
+// Close immediately closes all listeners, UDP relays and connections,
+// including ones still relaying. For a graceful shutdown, use Shutdown.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.inShutdown, 1)
 
-	// Read the version byte
-	version := []byte{0}
-	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Printf("socks: Failed to get version byte: %v", err)
-		return err
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	s.closeConns()
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// closeListenersLocked closes every tracked listener.
+// s.mu must be held.
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
+	return err
+}
 
-	// Ensure we are compatible
-	if version[0] != socks5Version {
-		err := fmt.Errorf("unsupported SOCKS version: %v", version)
-		s.config.Logger.Printf("socks: %v", err)
-		return err
+// closeConns force closes every tracked connection by cancelling its
+// session context
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.activeConn {
+		sess.kill(endReasonServerDown)
+	}
+}
+
+func (s *Server) numActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.activeConn)
+}
+
+// trackListener adds or removes a net.Listener to the set of tracked
+// listeners. It reports whether the server is still up (not Shutdown or
+// Closed).
+func (s *Server) trackListener(ln *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+// trackConn adds or removes a served session. It reports whether the
+// server still accepts new connections.
+func (s *Server) trackConn(sess *session, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[*session]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.activeConn[sess] = struct{}{}
+	} else {
+		delete(s.activeConn, sess)
+	}
+	return true
+}
+
+// beginRequest moves a tracked session out of the handshake. It
+// reports false if the server is shutting down, in which case the
+// request must not be started.
+func (s *Server) beginRequest(sess *session, req *Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess.setRequest(req)
+	sess.setPhase(PhaseDialing)
+	return !s.shuttingDown()
+}
+
+// setConnDeadline arms a deadline timeout from now on conn, or clears
+// it when timeout is zero
+func setConnDeadline(conn net.Conn, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
 	}
+	conn.SetDeadline(deadline)
+}
+
+// readSOCKS5Request authenticates the client and reads its request,
+// once the version byte was read. The returned context carries the
+// AuthContext.
+func (s *Server) readSOCKS5Request(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) (context.Context, *Request, error) {
+	log := s.logger(ctx)
 
 	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	authContext, err := s.authenticate(ctx, conn, bufConn)
 	if err != nil {
 		err = fmt.Errorf("failed to authenticate: %v", err)
-		s.config.Logger.Printf("socks: %v", err)
-		return err
+		log.Warn("authentication failed", "error", err)
+		return ctx, nil, err
 	}
+	ctx = context.WithValue(ctx, authContextContextKey, authContext)
+	sessionFromContext(ctx).setAuthContext(authContext)
 
+	setConnDeadline(conn, s.configFor(ctx).RequestTimeout)
 	request, err := NewRequest(bufConn)
 	if err != nil {
 		if err == errUnrecognizedAddrType {
-			if err := sendReply(conn, ReplyAddrTypeNotSupported, nil); err != nil {
-				s.config.Logger.Printf("socks: %v", err)
-				return fmt.Errorf("failed to send reply: %v", err)
+			if err := sendSessionReply(ctx, conn, ReplyAddrTypeNotSupported, nil); err != nil {
+				log.Warn("failed to send reply", "error", err)
+				return ctx, nil, fmt.Errorf("failed to send reply: %v", err)
 			}
 		}
-		s.config.Logger.Printf("socks: %v", err)
-		return fmt.Errorf("failed to read destination address: %v", err)
+		log.Warn("failed to read request", "error", err)
+		return ctx, nil, fmt.Errorf("failed to read destination address: %v", err)
 	}
 	request.AuthContext = authContext
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	return ctx, request, nil
+}
+
+// ServeConn is used to serve a single connection.
+func (s *Server) ServeConn(conn net.Conn) error {
+	return s.ServeConnContext(context.Background(), conn)
+}
+
+// ServeConnContext is used to serve a single connection. The session
+// gets its own context derived from ctx, carrying the client address,
+// the session ID and, once negotiated, the AuthContext. That context
+// is cancelled when the session ends or the server is closed, and
+// cancelling ctx closes conn.
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) (err error) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sess := newSession(conn, cancel)
+	conf := s.currentConfig()
+	ctx = context.WithValue(ctx, configContextKey, conf)
+	if d := conf.MaxSessionDuration; d > 0 {
+		var cancelTimeout context.CancelFunc
+		sess.lifetime = time.Now().Add(d)
+		ctx, cancelTimeout = context.WithDeadline(ctx, sess.lifetime)
+		defer cancelTimeout()
+	}
+
+	ctx = context.WithValue(ctx, sessionContextKey, sess)
+	log := s.logger(ctx)
+	if !s.trackConn(sess, true) {
+		return ErrServerClosed
+	}
+	defer s.trackConn(sess, false)
+	defer func() {
+		s.logAccess(ctx, sess, err)
+	}()
+	conf.Metrics.sessionStarted()
+	defer conf.Metrics.sessionEnded()
+
+	// Enforce the server wide limit before anything is read, there is no
+	// way to reply to the client yet
+	if !s.limits.acquireConn(conf.MaxConns) {
+		log.Warn("session rejected", "error", ErrTooManyConns)
+		return ErrTooManyConns
+	}
+	defer s.limits.releaseConn()
+
+	// Unblock any pending read or write once the session is cancelled
+	go func(ctx context.Context, conn net.Conn) {
+		<-ctx.Done()
+		conn.Close()
+	}(ctx, conn)
+
+	// Read the PROXY protocol header, it carries the client address
+	if pc := proxyProtocolConnOf(conn); pc != nil {
+		hdr, err := pc.ProxyHeader()
+		if err != nil {
+			err := fmt.Errorf("failed to read PROXY header: %v", err)
+			log.Warn("session rejected", "error", err)
+			return err
+		}
+		ctx = context.WithValue(ctx, proxyHeaderContextKey, hdr)
+		sess.setRemoteAddr(conn.RemoteAddr())
+	}
+	ctx = context.WithValue(ctx, clientAddrContextKey, conn.RemoteAddr())
+
+	// Enforce the per client IP limit once the client is known
+	if ip := clientIP(conn.RemoteAddr()); ip != "" {
+		if !s.limits.acquireIP(ip, conf.MaxConnsPerIP) {
+			log.Warn("session rejected", "error", ErrTooManyConnsPerIP)
+			return ErrTooManyConnsPerIP
+		}
+		defer s.limits.releaseIP(ip)
+	}
+
+	if cc, ok := conn.(interface {
+		WithContext(ctx context.Context) net.Conn
+	}); ok {
+		limitCtx := ctx
+		if conf.Metrics != nil {
+			limitCtx = bandwidth.WithWaitObserver(ctx, conf.Metrics.bandwidthWait)
+		}
+		conn = cc.WithContext(limitCtx)
+	}
+	conn = &countingConn{Conn: conn, sess: sess, metrics: conf.Metrics}
+	bufConn := bufio.NewReader(conn)
+
+	// Read the version byte
+	setConnDeadline(conn, conf.HandshakeTimeout)
+	peek, err := bufConn.Peek(1)
+	if err != nil {
+		log.Warn("failed to get version byte", "error", err)
+		return err
+	}
+	version := peek[0]
+
+	// Ensure we are compatible, and read the request of that version
+	var request *Request
+	switch {
+	case version == socks5Version:
+		bufConn.Discard(1)
+		ctx, request, err = s.readSOCKS5Request(ctx, conn, bufConn)
+	case version == socks4Version && conf.EnableSOCKS4:
+		bufConn.Discard(1)
+		ctx, request, err = s.readSOCKS4Request(ctx, conn, bufConn)
+	case isHTTPMethodStart(version) && conf.EnableHTTPProxy:
+		ctx, request, err = s.readHTTPRequest(ctx, conn, bufConn)
+	default:
+		err = fmt.Errorf("unsupported SOCKS version: %v", version)
+		log.Warn("handshake failed", "error", err)
+	}
+	if err != nil {
+		return err
+	}
+	authContext := request.AuthContext
+	setConnDeadline(conn, 0)
+	conf.Metrics.request(request.Command)
+	request.RemoteAddr = addrSpecOf(conn.RemoteAddr())
+
+	// Enforce the per user limit now that the request can be replied to
+	if user := authUsername(authContext); user != "" {
+		if !s.limits.acquireUser(user, conf.MaxConnsPerUser) {
+			err := sendSessionReply(ctx, conn, ReplyRuleFailure, nil)
+			log.Warn("session rejected", "error", ErrTooManyConnsPerUser)
+			if err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return ErrTooManyConnsPerUser
+		}
+		defer s.limits.releaseUser(user)
+	}
+
+	// Refuse the request if Shutdown was called during the handshake
+	if !s.beginRequest(sess, request) {
+		err := sendSessionReply(ctx, conn, ReplyServerFailure, nil)
+		log.Info("request refused", "error", ErrServerClosed)
+		if err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return ErrServerClosed
 	}
 
 	// Process the client request
-	if err := s.handleRequest(request, conn); err != nil {
+	log.Debug("handling request")
+	if err := s.handleRequest(ctx, request, conn); err != nil {
 		err = fmt.Errorf("failed to handle request: %v", err)
-		s.config.Logger.Printf("socks: %v", err)
-		s.config.Logger.Printf("waiting for jumpbox to be available...")
+		log.Warn("request failed", "error", err)
 		return err
 	}
 
+	log.Debug("session finished")
 	return nil
 }
@@ -0,0 +1,202 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoClientCert the client presented no verified certificate
+var ErrNoClientCert = errors.New("no verified client certificate")
+
+// NewTLSListener returns a listener terminating TLS with config before
+// serving SOCKS. The handshake runs in the session, bounded by
+// Config.HandshakeTimeout. To authenticate clients by certificate, set
+// config.ClientAuth and config.ClientCAs and enable a
+// TLSClientCertAuthenticator.
+func NewTLSListener(l net.Listener, config *tls.Config) net.Listener {
+	return tls.NewListener(l, config)
+}
+
+// CertReloader serves a certificate and key loaded from files, and
+// loads them again once either file changes on disk or Reload is
+// called. Use GetCertificate as tls.Config.GetCertificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// certCheckInterval is how often CertReloader looks for changed files
+const certCheckInterval = time.Second
+
+// NewCertReloader loads the PEM encoded certificate and key files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key files. The previous certificate
+// is kept if they can't be loaded.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load()
+}
+
+func (r *CertReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	r.cert, r.modTime, r.checkedAt = &cert, modTime, time.Now()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the files
+func (r *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the current certificate, loading it again
+// first if the files changed
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) >= certCheckInterval {
+		r.checkedAt = time.Now()
+		if modTime, err := r.filesModTime(); err == nil && !modTime.Equal(r.modTime) {
+			// Keep serving the previous certificate on a partial write
+			r.load()
+		}
+	}
+	return r.cert, nil
+}
+
+// CertIdentity selects the part of a client certificate used as the
+// identity of the client
+type CertIdentity int
+
+const (
+	// CertIdentityCommonName the subject common name
+	CertIdentityCommonName CertIdentity = iota
+	// CertIdentityDNSName the first DNS subject alternative name
+	CertIdentityDNSName
+	// CertIdentityEmail the first email subject alternative name
+	CertIdentityEmail
+	// CertIdentityURI the first URI subject alternative name, such as a
+	// SPIFFE ID
+	CertIdentityURI
+)
+
+// TLSClientCertAuthenticator authenticates clients of a TLS listener by
+// their verified certificate, without any subnegotiation. It is
+// negotiated as the "No Authentication" method, so it replaces
+// NoAuthAuthenticator, and it refuses clients without a verified
+// certificate. The identity is stored as Payload["Username"], so rules
+// and per-user limits apply to it, and the subject as
+// Payload["CertSubject"].
+type TLSClientCertAuthenticator struct {
+	// Identity selects the identity, defaults to the common name
+	Identity CertIdentity
+}
+
+// GetCode implementation of Authenticator
+func (a TLSClientCertAuthenticator) GetCode() uint8 {
+	return AuthMethodNoAuth
+}
+
+// Authenticate implementation of Authenticator
+func (a TLSClientCertAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	authContext, err := a.authContext(writer)
+	if err != nil {
+		writer.Write([]byte{socks5Version, AuthMethodNoAcceptable})
+		return nil, err
+	}
+	if _, err := writer.Write([]byte{socks5Version, AuthMethodNoAuth}); err != nil {
+		return nil, err
+	}
+	return authContext, nil
+}
+
+// authContext returns the AuthContext of the client certificate of the
+// connection found under w
+func (a TLSClientCertAuthenticator) authContext(w io.Writer) (*AuthContext, error) {
+	cert := verifiedClientCert(w)
+	if cert == nil {
+		return nil, ErrNoClientCert
+	}
+	identity := a.identity(cert)
+	if identity == "" {
+		return nil, fmt.Errorf("client certificate %q has no identity", cert.Subject)
+	}
+	return &AuthContext{AuthMethodNoAuth, map[string]string{
+		"Username":    identity,
+		"CertSubject": cert.Subject.String(),
+	}}, nil
+}
+
+func (a TLSClientCertAuthenticator) identity(cert *x509.Certificate) string {
+	switch a.Identity {
+	case CertIdentityDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertIdentityURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// verifiedClientCert returns the verified leaf certificate of the TLS
+// connection found under w, or nil
+func verifiedClientCert(w io.Writer) *x509.Certificate {
+	conn, _ := w.(net.Conn)
+	tc, ok := findConn(conn, func(c net.Conn) bool {
+		_, ok := c.(*tls.Conn)
+		return ok
+	}).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
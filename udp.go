@@ -1,167 +1,421 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/peterzam/socks5/bandwidth"
+)
+
+// maxUDPPacketSize fits any UDP datagram
+const maxUDPPacketSize = 64 * 1024
+
+/*********************************************************
+    UDP PACKAGE to proxy
+    +----+------+------+----------+----------+----------+
+    |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+    +----+------+------+----------+----------+----------+
+    | 2  |  1   |  1   | Variable |    2     | Variable |
+    +----+------+------+----------+----------+----------+
+**********************************************************/
+
+// ErrUDPFragmentNoSupported UDP fragments not supported error
+//
+// Deprecated: fragments are reassembled, it is no longer returned.
+var ErrUDPFragmentNoSupported = errors.New("UDP fragments not supported")
+
+// maxUDPHeaderLen is the longest header, with a 255 byte domain name
+const maxUDPHeaderLen = 3 + 1 + 1 + 255 + 2
+
+// parseUDPHeader parses the header of a UDP datagram, returning its
+// fragment number, its address and the length of the header
+func parseUDPHeader(packet []byte) (frag uint8, addr *AddrSpec, n int, err error) {
+	if len(packet) <= 3 {
+		return 0, nil, 0, fmt.Errorf("short UDP package header, %d bytes only", len(packet))
+	}
+	if packet[0] != 0x00 || packet[1] != 0x00 {
+		return 0, nil, 0, fmt.Errorf("unsupported socks UDP package header, %+v", packet[:2])
+	}
+	r := bytes.NewReader(packet[3:])
+	if addr, err = readAddrSpec(r); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("short UDP package Addr. header, %d bytes only", len(packet)-3)
+		}
+		return 0, nil, 0, err
+	}
+	return packet[2], addr, len(packet) - r.Len(), nil
+}
+
+// appendUDPHeader appends the header of a UDP datagram to addr to b
+func appendUDPHeader(b []byte, frag uint8, addr *AddrSpec) ([]byte, error) {
+	return appendAddrSpec(append(b, 0, 0, frag), addr)
+}
+
+// udpRelay is the relay socket of a single UDP association. It accepts
+// datagrams from the client of the association only, sends them on
+// through the mappings of its NAT table, and relays what comes back.
+type udpRelay struct {
+	conn *net.UDPConn
+
+	// stream carries the datagrams on the control connection instead of
+	// conn, for UDP over TCP. The connection then limits and counts the
+	// traffic itself.
+	stream *udpStream
+
+	// clientIP and clientPort are the client address declared in the
+	// request, or the IP of the control connection. A zero port matches
+	// any until the first datagram of the client sets client.
+	clientIP   net.IP
+	clientPort int
+	client     *net.UDPAddr
+
+	// reassembly queues the fragments of the client, which once it sent
+	// any gets large datagrams fragmented in turn
+	reassembly   *udpReassembler
+	fragments    int32 // accessed atomically
+	fragmentSize int
+
+	nat *udpNAT
+
+	// req is the UDP ASSOCIATE request, whose AuthContext and RemoteAddr
+	// the rules see for every destination. allowed caches their
+	// decisions by destination.
+	req     *Request
+	allowed map[string]bool
+
+	// readLimiter and writeLimiter are the bandwidth limiters of the
+	// control connection, nil when it has none. police drops datagrams
+	// over the limits instead of delaying them.
+	readLimiter  bandwidth.BandwidthLimiter
+	writeLimiter bandwidth.BandwidthLimiter
+	police       bool
+}
+
+// maxUDPRuleCache bounds the rule decisions cached per association
+const maxUDPRuleCache = 1024
+
+var (
+	// errUDPDenied the rules refused the destination of a datagram
+	errUDPDenied = errors.New("udp destination blocked by rules")
+	// errUDPPoliced a datagram exceeded the bandwidth limits
+	errUDPPoliced = errors.New("udp datagram over the bandwidth limit")
 )
 
-const maxUDPPacketSize = 2 * 1024
+// errUDPClientUnknown the client of an association has no IP to accept
+// datagrams from, on a unix socket without declaring one
+var errUDPClientUnknown = errors.New("udp client address unknown")
 
-var udpClientSrcAddr = &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+// listenUDPRelay opens the relay socket of an association requested over
+// conn, see udpRelayIP
+func (s *Server) listenUDPRelay(ctx context.Context, conn net.Conn, req *Request) (*udpRelay, error) {
+	r := &udpRelay{
+		clientIP:   req.DestAddr.IP,
+		clientPort: req.DestAddr.Port,
+		req:        req,
+		allowed:    make(map[string]bool),
+	}
+	if len(r.clientIP) == 0 || r.clientIP.IsUnspecified() {
+		tcp, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, errUDPClientUnknown
+		}
+		r.clientIP = tcp.IP
+	}
 
-var udpPacketBufferPool = sync.Pool{
-	New: func() interface{} {
-		return make([]byte, maxUDPPacketSize)
-	},
+	// Share the bandwidth limits of the control connection
+	if lc, ok := findLimitedConn(conn).(udpLimitedConn); ok {
+		r.readLimiter, r.writeLimiter = lc.Limiters()
+	}
+
+	ip := s.udpRelayIP(ctx, conn, r.clientIP)
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	r.conn = c
+	return r, nil
 }
 
-func getUDPPacketBuffer() []byte {
-	return udpPacketBufferPool.Get().([]byte)
+// udpRelayIP returns the IP the UDP relay of a session listens on: the
+// UDPRelayIP of its listener, else Config.UDPRelayIP, else the address
+// the client connected to, in its family. Clients on unix sockets get
+// the loopback address of the family of clientIP.
+func (s *Server) udpRelayIP(ctx context.Context, conn net.Conn, clientIP net.IP) net.IP {
+	if ls := listenerFromContext(ctx); ls != nil && len(ls.udpRelayIP) > 0 {
+		return ls.udpRelayIP
+	}
+	if ip := s.configFor(ctx).UDPRelayIP; len(ip) > 0 {
+		return ip
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && !local.IP.IsUnspecified() {
+		return local.IP
+	}
+	if clientIP.To4() == nil {
+		return net.IPv6loopback
+	}
+	return net.ParseIP("127.0.0.1")
 }
 
-func putUDPPacketBuffer(p []byte) {
-	p = p[:cap(p)]
-	udpPacketBufferPool.Put(&p)
+// fromClient reports whether src is the client of the association
+func (r *udpRelay) fromClient(src *net.UDPAddr) bool {
+	if r.client != nil {
+		return r.client.IP.Equal(src.IP) && r.client.Port == src.Port
+	}
+	if !r.clientIP.Equal(src.IP) {
+		return false
+	}
+	if r.clientPort != 0 && r.clientPort != src.Port {
+		return false
+	}
+	r.client = src
+	return true
 }
 
-//FIXME: insecure implementation of UDP server, anyone could send package here without authentication
+// serveUDPRelay relays the datagrams of an association until its socket
+// is closed
+func (s *Server) serveUDPRelay(ctx context.Context, r *udpRelay) {
+	s.startUDPRelay(ctx, r)
+	defer r.stop()
 
-func (s *Server) handleUDP(udpConn *net.UDPConn) {
+	log := s.logger(ctx)
+	metrics := s.configFor(ctx).Metrics
+	buf := make([]byte, maxUDPPacketSize)
 	for {
-		buffer := getUDPPacketBuffer()
-		n, src, err := udpConn.ReadFromUDP(buffer)
+		n, src, err := r.conn.ReadFromUDP(buf)
 		if err != nil {
-			s.config.Logger.Printf("udp socks: Failed to accept udp traffic: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warn("failed to read udp traffic", "error", err)
+			continue
 		}
-		buffer = buffer[:n]
-		go func() {
-			defer putUDPPacketBuffer(buffer)
-			s.serveUDPConn(buffer, func(data []byte) error {
-				_, err := udpConn.WriteToUDP(data, src)
-				return err
-			})
-		}()
+		if !r.fromClient(src) {
+			// Replies come in through the mappings
+			continue
+		}
+		ctx := context.WithValue(ctx, clientAddrContextKey, src)
+		metrics.udpDatagram(s.relayUDPFromClient(ctx, r, buf[:n]))
 	}
 }
 
-/*********************************************************
-    UDP PACKAGE to proxy
-    +----+------+------+----------+----------+----------+
-    |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
-    +----+------+------+----------+----------+----------+
-    | 2  |  1   |  1   | Variable |    2     | Variable |
-    +----+------+------+----------+----------+----------+
-**********************************************************/
+// startUDPRelay sets up the reassembly queue and the NAT table of an
+// association, which stop releases
+func (s *Server) startUDPRelay(ctx context.Context, r *udpRelay) {
+	conf := s.configFor(ctx)
+	log := s.logger(ctx)
+	metrics := conf.Metrics
 
-// ErrUDPFragmentNoSupported UDP fragments not supported error
-var ErrUDPFragmentNoSupported = errors.New("")
+	r.reassembly = &udpReassembler{
+		timeout:  conf.UDPReassemblyTimeout,
+		maxBytes: conf.UDPMaxReassemblyBytes,
+		onAbandon: func(reason string, dest *AddrSpec) {
+			metrics.udpReassembly(reason)
+			log.Warn("abandoned udp reassembly", "dest", dest.String(), "reason", reason)
+		},
+	}
+	if r.reassembly.timeout <= 0 {
+		r.reassembly.timeout = defaultUDPReassemblyTimeout
+	}
+	if r.reassembly.maxBytes <= 0 {
+		r.reassembly.maxBytes = maxUDPPacketSize
+	}
+	r.fragmentSize = conf.UDPFragmentSize
+	if r.fragmentSize <= 0 {
+		r.fragmentSize = defaultUDPFragmentSize
+	}
 
-func (s *Server) serveUDPConn(udpPacket []byte, reply func([]byte) error) error {
-	// RSV  Reserved X'0000'
-	// FRAG Current fragment number, donnot support fragment here
-	header := []byte{0, 0, 0}
-	if len(udpPacket) <= 3 {
-		err := fmt.Errorf("short UDP package header, %d bytes only", len(udpPacket))
-		s.config.Logger.Printf("udp socks: Failed to get UDP package header: %v", err)
-		return err
+	r.police = conf.UDPBandwidthPolicing
+	sess := sessionFromContext(ctx)
+	r.nat = newUDPNAT(conf.UDPFilter, conf.UDPMappingIdleTimeout, conf.MaxUDPMappings, s.egressIP(ctx), func(src *net.UDPAddr, data, reply []byte) {
+		if err := r.limit(ctx, false, len(data)); err != nil {
+			return
+		}
+		if err := r.sendToClient(src, data, reply); err != nil {
+			log.Warn("failed to send udp response", "dest", src.String(), "error", err)
+			return
+		}
+		if r.stream == nil {
+			sess.addBytesDown(len(data))
+			metrics.addBytesDown(len(data))
+		}
+	})
+}
+
+// stop drops the reassembly queue and closes the NAT table once the
+// association ends
+func (r *udpRelay) stop() {
+	r.reassembly.stop()
+	r.nat.close()
+}
+
+// sendToClient wraps data from src in the UDP header and sends it to
+// the client, fragmented if it reassembles fragments. reply is a buffer
+// for the datagrams.
+func (r *udpRelay) sendToClient(src *net.UDPAddr, data, reply []byte) error {
+	if r.stream != nil {
+		packet, err := appendUDPHeader(reply[:0], 0, &AddrSpec{IP: src.IP, Port: src.Port})
+		if err != nil {
+			return err
+		}
+		return r.stream.write(append(packet, data...))
 	}
-	if header[0] != 0x00 || header[1] != 0x00 {
-		err := fmt.Errorf("unsupported socks UDP package header, %+v", header[:2])
-		s.config.Logger.Printf("udp socks: Failed to parse UDP package header: %v", err)
-		return err
+
+	// Fragment large datagrams to clients known to reassemble them
+	count, size := 1, len(data)
+	if atomic.LoadInt32(&r.fragments) != 0 {
+		if count = udpFragmentCount(len(data), r.fragmentSize); count > 1 {
+			size = r.fragmentSize
+		}
 	}
-	if header[2] != 0x00 {
-		s.config.Logger.Printf("udp socks: %+v", ErrUDPFragmentNoSupported)
-		return ErrUDPFragmentNoSupported
+	for i := 0; i < count; i++ {
+		frag := uint8(0)
+		if count > 1 {
+			frag = uint8(i + 1)
+			if i == count-1 {
+				frag |= udpFragEnd
+			}
+		}
+		chunk := data[i*size:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		packet, err := appendUDPHeader(reply[:0], frag, &AddrSpec{IP: src.IP, Port: src.Port})
+		if err != nil {
+			return err
+		}
+		if _, err := r.conn.WriteToUDP(append(packet, chunk...), r.client); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// relayUDPFromClient sends the data of a datagram of the client to its
+// destination
+func (s *Server) relayUDPFromClient(ctx context.Context, r *udpRelay, udpPacket []byte) error {
+	log := s.logger(ctx)
 
-	// Read in the destination address
-	targetAddrRaw := udpPacket[3:]
-	targetAddrSpec := &AddrSpec{}
-	targetAddrRawSize := 0
-	errShortAddrRaw := func() error {
-		err := fmt.Errorf("short UDP package Addr. header, %d bytes only", len(targetAddrRaw))
-		s.config.Logger.Printf("udp socks: Failed to get UDP package header: %v", err)
+	// RSV  Reserved X'0000'
+	// FRAG Current fragment number, X'00' for a standalone datagram
+	frag, targetAddrSpec, headerLen, err := parseUDPHeader(udpPacket)
+	if err != nil {
+		log.Warn("failed to get udp packet header", "error", err)
 		return err
 	}
-	if len(targetAddrRaw) < 1+4+2 /* ATYP + DST.ADDR.IPV4 + DST.PORT */ {
-		return errShortAddrRaw()
-	}
-	targetAddrRawSize = 1
-	switch targetAddrRaw[0] {
-	case AddressIPv4:
-		targetAddrSpec.IP = net.IP(targetAddrRaw[targetAddrRawSize : targetAddrRawSize+4])
-		targetAddrRawSize += 4
-	case AddressIPv6:
-		if len(targetAddrRaw) < 1+16+2 {
-			return errShortAddrRaw()
-		}
-		targetAddrSpec.IP = net.IP(targetAddrRaw[1 : 1+16])
-		targetAddrRawSize += 16
-	case AddressDomainName:
-		addrLen := int(targetAddrRaw[1])
-		if len(targetAddrRaw) < 1+1+addrLen+2 {
-			return errShortAddrRaw()
-		}
-		targetAddrSpec.FQDN = string(targetAddrRaw[1+1 : 1+1+addrLen])
-		targetAddrRawSize += (1 + addrLen)
-	default:
-		s.config.Logger.Printf("udp socks: Failed to get UDP package header: %v", errUnrecognizedAddrType)
-		return errUnrecognizedAddrType
-	}
-	targetAddrSpec.Port = (int(targetAddrRaw[targetAddrRawSize]) << 8) | int(targetAddrRaw[targetAddrRawSize+1])
-	targetAddrRawSize += 2
-	targetAddrRaw = targetAddrRaw[:targetAddrRawSize]
+	data := udpPacket[headerLen:]
+	if frag != 0x00 {
+		atomic.StoreInt32(&r.fragments, 1)
+		dest, whole, ok := r.reassembly.add(frag, targetAddrSpec, data)
+		if !ok {
+			return nil
+		}
+		s.configFor(ctx).Metrics.udpReassembly(udpReassemblyCompleted)
+		targetAddrSpec, data = dest, whole
+	}
 
 	// resolve addr.
 	if targetAddrSpec.FQDN != "" {
-		_, addr, err := s.config.Resolver.Resolve(context.TODO(), targetAddrSpec.FQDN)
+		_, addr, err := s.resolve(ctx, targetAddrSpec.FQDN)
 		if err != nil {
 			err := fmt.Errorf("failed to resolve destination '%v': %v", targetAddrSpec.FQDN, err)
-			s.config.Logger.Printf("udp socks: %+v", err)
+			log.Warn("udp resolve failed", "dest", targetAddrSpec.String(), "error", err)
 			return err
 		}
 		targetAddrSpec.IP = addr
 	}
 
-	// make a writer and write to dst
-	targetUDPAddr, err := net.ResolveUDPAddr("udp", targetAddrSpec.Address())
-	if err != nil {
-		err := fmt.Errorf("failed to resolve destination UDP Addr '%v': %v", targetAddrSpec.Address(), err)
-		return err
+	// Check the resolved destination against the rules
+	if !s.allowUDP(ctx, r, targetAddrSpec) {
+		return errUDPDenied
 	}
-	target, err := net.DialUDP("udp", udpClientSrcAddr, targetUDPAddr)
-	if err != nil {
-		err = fmt.Errorf("connect to %v failed: %v", targetUDPAddr, err)
-		s.config.Logger.Printf("udp socks: %+v", err)
+
+	if err := r.limit(ctx, true, len(data)); err != nil {
 		return err
 	}
-	defer target.Close()
 
-	// write data to target and read the response back
-	if _, err := target.Write(udpPacket[len(header)+len(targetAddrRaw):]); err != nil {
-		s.config.Logger.Printf("udp socks: fail to write udp data to dest %s: %+v",
-			targetUDPAddr.String(), err)
+	target := &net.UDPAddr{IP: targetAddrSpec.IP, Port: targetAddrSpec.Port}
+	if err := r.nat.send(target, data); err != nil {
+		log.Warn("failed to write udp data", "dest", targetAddrSpec.String(), "error", err)
 		return err
 	}
-	respBuffer := getUDPPacketBuffer()
-	defer putUDPPacketBuffer(respBuffer)
-	copy(respBuffer[0:len(header)], header)
-	copy(respBuffer[len(header):len(header)+len(targetAddrRaw)], targetAddrRaw)
-	n, err := target.Read(respBuffer[len(header)+len(targetAddrRaw):])
-	if err != nil {
-		s.config.Logger.Printf("udp socks: fail to read udp resp from dest %s: %+v",
-			targetUDPAddr.String(), err)
-		return err
+	if r.stream == nil {
+		sessionFromContext(ctx).addBytesUp(len(data))
+		s.configFor(ctx).Metrics.addBytesUp(len(data))
 	}
-	respBuffer = respBuffer[:len(header)+len(targetAddrRaw)+n]
+	return nil
+}
 
-	if reply(respBuffer); err != nil {
-		s.config.Logger.Printf("udp socks: fail to send udp resp back: %+v", err)
-		return err
+// udpLimitedConn is a bandwidth limited connection, whose limiters the
+// UDP traffic of its session shares
+type udpLimitedConn interface {
+	Limiters() (read, write bandwidth.BandwidthLimiter)
+}
+
+// findLimitedConn returns the bandwidth limited connection conn wraps,
+// or nil
+func findLimitedConn(conn net.Conn) net.Conn {
+	return findConn(conn, func(c net.Conn) bool {
+		_, ok := c.(udpLimitedConn)
+		return ok
+	})
+}
+
+// limit waits until n bytes of data may be relayed, read is the client
+// to destination direction. When policing, it fails at once instead if
+// the limiter supports it.
+func (r *udpRelay) limit(ctx context.Context, read bool, n int) error {
+	l := r.writeLimiter
+	if read {
+		l = r.readLimiter
 	}
-	return nil
+	if l == nil {
+		return nil
+	}
+	if al, ok := l.(bandwidth.AllowLimiter); ok && r.police {
+		if !al.AllowN(int64(n)) {
+			return errUDPPoliced
+		}
+		return nil
+	}
+	start := time.Now()
+	err := l.WaitN(ctx, int64(n))
+	metricsFromContext(ctx).bandwidthWait(read, time.Since(start))
+	return err
+}
+
+// allowUDP reports whether the rules allow datagrams to dest, asking
+// them once per destination of the association
+func (s *Server) allowUDP(ctx context.Context, r *udpRelay, dest *AddrSpec) bool {
+	key := dest.String()
+	if allowed, ok := r.allowed[key]; ok {
+		return allowed
+	}
+
+	req := &Request{
+		Version:      r.req.Version,
+		Command:      CommandAssociate,
+		AuthContext:  r.req.AuthContext,
+		RemoteAddr:   r.req.RemoteAddr,
+		DestAddr:     dest,
+		realDestAddr: dest,
+	}
+	_, allowed := s.configFor(ctx).Rules.Allow(ctx, req)
+	if !allowed {
+		s.logger(ctx).Warn("udp destination blocked by rules", "dest", key)
+	}
+	if len(r.allowed) >= maxUDPRuleCache {
+		r.allowed = make(map[string]bool)
+	}
+	r.allowed[key] = allowed
+	return allowed
 }
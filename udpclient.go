@@ -0,0 +1,233 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ListenPacket performs a UDP ASSOCIATE and returns a net.PacketConn
+// relaying datagrams through the server. ctx bounds the handshake only,
+// the association lasts until the PacketConn is closed or the server
+// closes the control connection. With UDPOverTCP the datagrams go on the
+// connection itself instead.
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if d.UDPOverTCP {
+		return d.listenPacketTCP(ctx)
+	}
+
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("socks5: failed to listen for udp: %v", err)
+	}
+
+	ctrl, err := d.dialProxy(ctx)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("socks5: failed to connect to proxy %s: %v", d.ProxyAddress, err)
+	}
+	// The client address is unknown behind NAT, leave it to the server
+	bound, err := d.handshake(ctx, ctrl, CommandAssociate, nil)
+	if err != nil {
+		ctrl.Close()
+		pc.Close()
+		return nil, err
+	}
+
+	// An unspecified relay address is the address of the server
+	relay := &net.UDPAddr{IP: bound.IP, Port: bound.Port}
+	if bound.FQDN != "" || bound.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+		relay.IP = net.ParseIP(host)
+	}
+	if relay.IP == nil {
+		ctrl.Close()
+		pc.Close()
+		return nil, fmt.Errorf("socks5: unusable udp relay address: %v", bound)
+	}
+
+	c := &udpAssociation{PacketConn: pc, ctrl: ctrl, relay: relay}
+	go c.watchControl()
+	return c, nil
+}
+
+// udpAssociation is the client side of a UDP association
+type udpAssociation struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// watchControl tears the association down once the server closes the
+// control connection
+func (c *udpAssociation) watchControl() {
+	buf := make([]byte, 1)
+	for {
+		if _, err := c.ctrl.Read(buf); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+// WriteTo sends p to addr through the relay. addr may hold a domain
+// name the server resolves.
+func (c *udpAssociation) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dest, err := udpAddrSpec(addr)
+	if err != nil {
+		return 0, err
+	}
+	packet, err := appendUDPHeader(make([]byte, 0, maxUDPHeaderLen+len(p)), 0, dest)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(append(packet, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom reads a datagram from the relay into p, returning the address
+// it came from. Datagrams from elsewhere and fragments are dropped.
+func (c *udpAssociation) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPHeaderLen+len(p))
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(c.relay.IP) || udp.Port != c.relay.Port {
+			continue
+		}
+		frag, src, headerLen, err := parseUDPHeader(buf[:n])
+		if err != nil || frag != 0 {
+			continue
+		}
+		return copy(p, buf[headerLen:n]), udpSourceAddr(src), nil
+	}
+}
+
+// Close closes the UDP socket and the control connection, ending the
+// association
+func (c *udpAssociation) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.PacketConn.Close()
+		c.ctrl.Close()
+	})
+	return c.closeErr
+}
+
+// listenPacketTCP performs a UDP OVER TCP request and returns a
+// net.PacketConn carrying the datagrams on its connection
+func (d *Dialer) listenPacketTCP(ctx context.Context) (net.PacketConn, error) {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: failed to connect to proxy %s: %v", d.ProxyAddress, err)
+	}
+	if _, err := d.handshake(ctx, conn, CommandUDPOverTCP, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &udpOverTCPConn{
+		conn:   conn,
+		br:     bufio.NewReader(conn),
+		stream: &udpStream{w: conn},
+		buf:    make([]byte, maxUDPFrameLen),
+	}, nil
+}
+
+// udpOverTCPConn is the client side of a UDP OVER TCP association
+type udpOverTCPConn struct {
+	conn   net.Conn
+	stream *udpStream
+
+	// br and buf read the frames, one reader at a time
+	mu  sync.Mutex
+	br  *bufio.Reader
+	buf []byte
+}
+
+// WriteTo sends p to addr in a frame. addr may hold a domain name the
+// server resolves.
+func (c *udpOverTCPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dest, err := udpAddrSpec(addr)
+	if err != nil {
+		return 0, err
+	}
+	packet, err := appendUDPHeader(make([]byte, 0, maxUDPHeaderLen+len(p)), 0, dest)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.stream.write(append(packet, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom reads the datagram of the next frame into p, returning the
+// address it came from. Fragments are dropped.
+func (c *udpOverTCPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		packet, err := readUDPFrame(c.br, c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		frag, src, headerLen, err := parseUDPHeader(packet)
+		if err != nil || frag != 0 {
+			continue
+		}
+		return copy(p, packet[headerLen:]), udpSourceAddr(src), nil
+	}
+}
+
+// Close closes the connection, ending the association
+func (c *udpOverTCPConn) Close() error                       { return c.conn.Close() }
+func (c *udpOverTCPConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *udpOverTCPConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *udpOverTCPConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *udpOverTCPConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// udpSourceAddr converts the address of a datagram from the server to a
+// net.Addr
+func udpSourceAddr(src *AddrSpec) net.Addr {
+	if src.FQDN != "" {
+		return udpDomainAddr(net.JoinHostPort(src.FQDN, strconv.Itoa(src.Port)))
+	}
+	return &net.UDPAddr{IP: src.IP, Port: src.Port}
+}
+
+// udpDomainAddr is the address of a datagram the server sent with a
+// domain name
+type udpDomainAddr string
+
+func (a udpDomainAddr) Network() string { return "udp" }
+func (a udpDomainAddr) String() string  { return string(a) }
+
+// udpAddrSpec converts addr to an AddrSpec
+func udpAddrSpec(addr net.Addr) (*AddrSpec, error) {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return &AddrSpec{IP: udp.IP, Port: udp.Port}, nil
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("socks5: invalid port: %s", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: port}, nil
+	}
+	return &AddrSpec{FQDN: host, Port: port}, nil
+}
@@ -0,0 +1,133 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// udpFragEnd marks the last fragment of a datagram in the FRAG field
+	udpFragEnd = 0x80
+	// maxUDPFragments is the highest fragment position
+	maxUDPFragments = 0x7f
+
+	// defaultUDPReassemblyTimeout is the reassembly timer, no less than
+	// the 5 seconds RFC 1928 asks for
+	defaultUDPReassemblyTimeout = 5 * time.Second
+	// defaultUDPFragmentSize is the data size of the fragments sent to
+	// clients, fitting an Ethernet MTU with the longest header
+	defaultUDPFragmentSize = 1200
+)
+
+// Reasons of abandoning a reassembly queue, used as metric labels
+const (
+	udpReassemblyCompleted  = "completed"
+	udpReassemblyOutOfOrder = "out_of_order"
+	udpReassemblyMismatch   = "dest_mismatch"
+	udpReassemblyTimeout    = "timeout"
+	udpReassemblyTooLarge   = "too_large"
+)
+
+// udpReassembler is the reassembly queue of the fragmented datagrams of
+// a client. Fragments come in increasing positions from 1, the last one
+// has udpFragEnd set, all to the same destination. The queue is
+// abandoned on any other position or destination, once it holds more
+// than maxBytes, or when the reassembly timer started by its first
+// fragment fires.
+type udpReassembler struct {
+	timeout   time.Duration
+	maxBytes  int
+	onAbandon func(reason string, dest *AddrSpec)
+
+	mu    sync.Mutex
+	last  uint8 // position of the last queued fragment, 0 when empty
+	dest  *AddrSpec
+	data  []byte
+	timer *time.Timer
+	gen   int // invalidates the timers of abandoned queues
+}
+
+// add queues a fragment, returning the destination and data of the
+// datagram it completes
+func (q *udpReassembler) add(frag uint8, dest *AddrSpec, data []byte) (*AddrSpec, []byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pos := frag & maxUDPFragments
+	if q.last != 0 && pos != q.last+1 {
+		q.abandonLocked(udpReassemblyOutOfOrder)
+	} else if q.last != 0 && !sameAddrSpec(q.dest, dest) {
+		q.abandonLocked(udpReassemblyMismatch)
+	}
+	if q.last == 0 {
+		if pos != 1 {
+			// The rest of an abandoned datagram
+			return nil, nil, false
+		}
+		q.dest = dest
+		q.gen++
+		gen := q.gen
+		q.timer = time.AfterFunc(q.timeout, func() { q.expire(gen) })
+	}
+	if len(q.data)+len(data) > q.maxBytes {
+		q.abandonLocked(udpReassemblyTooLarge)
+		return nil, nil, false
+	}
+	q.data = append(q.data, data...)
+	q.last = pos
+
+	if frag&udpFragEnd == 0 {
+		return nil, nil, false
+	}
+	dest, data = q.dest, q.data
+	q.resetLocked()
+	return dest, data, true
+}
+
+func (q *udpReassembler) expire(gen int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if gen == q.gen && q.last != 0 {
+		q.abandonLocked(udpReassemblyTimeout)
+	}
+}
+
+func (q *udpReassembler) abandonLocked(reason string) {
+	q.onAbandon(reason, q.dest)
+	q.resetLocked()
+}
+
+func (q *udpReassembler) resetLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.last, q.dest, q.data = 0, nil, nil
+}
+
+// stop drops the queue once the association ends
+func (q *udpReassembler) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.gen++
+	q.resetLocked()
+}
+
+// sameAddrSpec reports whether a and b name the same destination
+func sameAddrSpec(a, b *AddrSpec) bool {
+	return a.FQDN == b.FQDN && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// udpFragmentCount returns the number of fragments of size bytes of
+// data, or 1 when it is sent whole: when it fits or needs more
+// fragments than the FRAG field can number
+func udpFragmentCount(dataLen, size int) int {
+	if size <= 0 || dataLen <= size {
+		return 1
+	}
+	n := (dataLen + size - 1) / size
+	if n > maxUDPFragments {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPFilter selects which datagrams coming back to the mapping of a
+// destination are relayed to the client, as in RFC 4787
+type UDPFilter int
+
+const (
+	// UDPFilterAddressDependent relays datagrams from the IP address of
+	// the destination of the mapping only
+	UDPFilterAddressDependent UDPFilter = iota
+	// UDPFilterEndpointIndependent relays datagrams from anyone, which
+	// makes the mapping a full cone
+	UDPFilterEndpointIndependent
+)
+
+// defaultUDPMappingIdleTimeout expires mappings without outbound traffic,
+// the minimum of RFC 4787
+const defaultUDPMappingIdleTimeout = 2 * time.Minute
+
+// defaultMaxUDPMappings caps the mappings of an association
+const defaultMaxUDPMappings = 256
+
+// udpNAT is the NAT table of a UDP association. Every destination gets
+// a mapping, its own outbound socket, which lasts until it saw no
+// datagram from the client for the idle timeout, or the association
+// ends. Datagrams to new destinations beyond max mappings are dropped.
+type udpNAT struct {
+	filter  UDPFilter
+	timeout time.Duration
+	max     int
+	// egressIP is the address the mappings send from, when of the
+	// family of their destination
+	egressIP net.IP
+	reply    func(src *net.UDPAddr, data, buf []byte)
+
+	mu       sync.Mutex
+	mappings map[string]*udpMapping
+	closed   bool
+}
+
+// udpMapping is the outbound socket of a destination
+type udpMapping struct {
+	conn       *net.UDPConn
+	dest       *net.UDPAddr
+	lastActive int64 // unix nanoseconds of the last send, accessed atomically
+}
+
+// errUDPNATClosed the association ended
+var errUDPNATClosed = errors.New("udp association closed")
+
+// errUDPTooManyMappings the association has as many mappings as allowed
+var errUDPTooManyMappings = errors.New("too many udp destinations")
+
+func newUDPNAT(filter UDPFilter, timeout time.Duration, max int, egressIP net.IP, reply func(src *net.UDPAddr, data, buf []byte)) *udpNAT {
+	if timeout <= 0 {
+		timeout = defaultUDPMappingIdleTimeout
+	}
+	if max <= 0 {
+		max = defaultMaxUDPMappings
+	}
+	return &udpNAT{
+		filter:   filter,
+		timeout:  timeout,
+		max:      max,
+		egressIP: egressIP,
+		reply:    reply,
+		mappings: make(map[string]*udpMapping),
+	}
+}
+
+// send sends data to dest through its mapping, creating it if needed
+func (n *udpNAT) send(dest *net.UDPAddr, data []byte) error {
+	for retry := true; ; retry = false {
+		m, err := n.mapping(dest)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&m.lastActive, time.Now().UnixNano())
+		_, err = m.conn.WriteToUDP(data, dest)
+		// The mapping may have just expired, try a new one
+		if err == nil || !retry || !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+}
+
+func (n *udpNAT) mapping(dest *net.UDPAddr) (*udpMapping, error) {
+	key := dest.String()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, errUDPNATClosed
+	}
+	if m, ok := n.mappings[key]; ok {
+		return m, nil
+	}
+	if len(n.mappings) >= n.max {
+		return nil, errUDPTooManyMappings
+	}
+
+	network := "udp4"
+	if dest.IP.To4() == nil {
+		network = "udp6"
+	}
+	var laddr *net.UDPAddr
+	if len(n.egressIP) > 0 && (n.egressIP.To4() == nil) == (network == "udp6") {
+		laddr = &net.UDPAddr{IP: n.egressIP}
+	}
+	c, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	m := &udpMapping{conn: c, dest: dest, lastActive: time.Now().UnixNano()}
+	n.mappings[key] = m
+	go n.serveMapping(key, m)
+	return m, nil
+}
+
+// serveMapping relays the datagrams coming back to m until it expires
+// or is closed
+func (n *udpNAT) serveMapping(key string, m *udpMapping) {
+	defer n.remove(key, m)
+	buf := make([]byte, maxUDPPacketSize)
+	reply := make([]byte, 0, maxUDPHeaderLen+maxUDPPacketSize)
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&m.lastActive)))
+		if idle >= n.timeout {
+			return
+		}
+		m.conn.SetReadDeadline(time.Now().Add(n.timeout - idle))
+
+		size, src, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		if n.filter == UDPFilterAddressDependent && !src.IP.Equal(m.dest.IP) {
+			continue
+		}
+		n.reply(src, buf[:size], reply)
+	}
+}
+
+func (n *udpNAT) remove(key string, m *udpMapping) {
+	n.mu.Lock()
+	if n.mappings[key] == m {
+		delete(n.mappings, key)
+	}
+	n.mu.Unlock()
+	m.conn.Close()
+}
+
+// close closes every mapping once the association ends
+func (n *udpNAT) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for _, m := range n.mappings {
+		m.conn.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+/*********************************************************
+    UDP OVER TCP frame, sent both ways on the connection
+    of the request after the reply:
+
+    +-----+-------------------------+
+    | LEN |       UDP PACKAGE       |
+    +-----+-------------------------+
+    |  2  | LEN, at most X'FFFF'    |
+    +-----+-------------------------+
+**********************************************************/
+
+// maxUDPFrameLen is the longest UDP package a frame carries
+const maxUDPFrameLen = 0xffff
+
+// errUDPFrameTooLarge a datagram does not fit a frame
+var errUDPFrameTooLarge = errors.New("udp datagram too large for a frame")
+
+// udpStream writes frames to a connection, one at a time
+type udpStream struct {
+	mu sync.Mutex
+	w  io.Writer
+	// buf holds a frame being written
+	buf []byte
+}
+
+// write writes packet in a frame
+func (st *udpStream) write(packet []byte) error {
+	if len(packet) > maxUDPFrameLen {
+		return errUDPFrameTooLarge
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.buf = append(append(st.buf[:0], byte(len(packet)>>8), byte(len(packet))), packet...)
+	_, err := st.w.Write(st.buf)
+	return err
+}
+
+// readUDPFrame reads the UDP package of a frame into buf, which must fit
+// maxUDPFrameLen bytes
+func readUDPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// handleUDPOverTCP serves a UDP association whose datagrams come and go
+// in frames on conn. They take the egress path, rules and limits of UDP
+// ASSOCIATE; the connection limits and counts them as its own traffic.
+func (s *Server) handleUDPOverTCP(ctx context.Context, conn net.Conn, req *Request) error {
+	ctx, release, err := s.admitAssociation(ctx, conn, req)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The datagrams need no relay address
+	if err := sendSessionReply(ctx, conn, ReplySucceeded, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	sessionFromContext(ctx).setPhase(PhaseRelaying)
+
+	r := &udpRelay{
+		stream:  &udpStream{w: conn},
+		req:     req,
+		allowed: make(map[string]bool),
+	}
+	s.startUDPRelay(ctx, r)
+	defer r.stop()
+
+	// The association lasts until the client closes the connection, or
+	// the server closes it on shutdown
+	metrics := s.configFor(ctx).Metrics
+	buf := make([]byte, maxUDPFrameLen)
+	for {
+		packet, err := readUDPFrame(req.BufConn, buf)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read udp frame: %v", err)
+		}
+		metrics.udpDatagram(s.relayUDPFromClient(ctx, r, packet))
+	}
+}